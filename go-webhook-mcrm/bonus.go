@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	BonusPending   = "pending"
+	BonusSent      = "sent"
+	BonusConfirmed = "confirmed"
+	BonusFailed    = "failed"
+)
+
+// BonusLedgerEntry is written before the MCRM accrual call, so a crash or a failed subscriber
+// update can never lead to the same bonus being granted twice.
+type BonusLedgerEntry struct {
+	ID            string  `json:"id"`
+	Key           string  `json:"key"`
+	SubscriberID  string  `json:"subscriber_id"`
+	SubscriberUID int     `json:"subscriber_uid"`
+	CampaignID    string  `json:"campaign_id"`
+	ListID        int     `json:"list_id"`
+	Phone         string  `json:"phone"`
+	Sum           float64 `json:"sum"`
+	State         string  `json:"state"`
+	Response      string  `json:"response"`
+	Error         string  `json:"error"`
+	Timestamp     string  `json:"timestamp"`
+}
+
+type BonusLedgerStore interface {
+	FindBonus(ctx context.Context, key string) (*BonusLedgerEntry, error)
+	CreateBonus(ctx context.Context, entry *BonusLedgerEntry) error
+	UpdateBonus(ctx context.Context, entry *BonusLedgerEntry) error
+	ListBonuses(ctx context.Context, opts ListOptions) (*RecordPage[BonusLedgerEntry], error)
+}
+
+// bonusKey keeps the original per-list key for the default campaign so its existing ledger entries still match.
+func bonusKey(uid int, campaign CampaignConfig) string {
+	if campaign.ID == defaultCampaignID {
+		return fmt.Sprintf("bonus-%d-%d", uid, campaign.ListID)
+	}
+	return fmt.Sprintf("bonus-%d-%s", uid, campaign.ID)
+}
+
+// campaignID resolves the campaign of entries written before campaigns existed.
+func (e *BonusLedgerEntry) campaignID() string {
+	if e.CampaignID == "" {
+		return defaultCampaignID
+	}
+	return e.CampaignID
+}
+
+// saveBonusState ignores cancellation, the ledger has to reflect an accrual that already reached MCRM.
+func (a *App) saveBonusState(ctx context.Context, entry *BonusLedgerEntry, state, errorMessage string) error {
+	ctx = context.WithoutCancel(ctx)
+	entry.State = state
+	entry.Error = errorMessage
+	entry.Timestamp = time.Now().Format(time.RFC3339)
+	if entry.ID == "" {
+		return a.bonuses.CreateBonus(ctx, entry)
+	}
+	return a.bonuses.UpdateBonus(ctx, entry)
+}
+
+// grantBonus accrues the campaign bonus in MCRM at most once per subscriber. Only errors worth
+// a bonus retry are returned, a failed subscriber update is left to the ledger to finish. A
+// failed accrual belongs to its bonus retry from then on and is not sent again here.
+func (a *App) grantBonus(ctx context.Context, sub *SubscriberEntry, campaign CampaignConfig) error {
+	return a.accrueBonus(ctx, sub, campaign, false)
+}
+
+// resendBonus is the bonus retry's attempt. The retry queue is the only caller re-sending failed
+// accruals, so the ledger's check-then-write never races the subscription scheduler.
+func (a *App) resendBonus(ctx context.Context, sub *SubscriberEntry, campaign CampaignConfig) error {
+	return a.accrueBonus(ctx, sub, campaign, true)
+}
+
+func (a *App) accrueBonus(ctx context.Context, sub *SubscriberEntry, campaign CampaignConfig, resendFailed bool) error {
+	key := bonusKey(sub.UID, campaign)
+
+	entry, err := a.bonuses.FindBonus(ctx, key)
+	if err != nil && !errors.Is(err, ErrRecordNotFound) {
+		return fmt.Errorf("bonus ledger lookup error: %v", err)
+	}
+
+	if entry != nil {
+		switch entry.State {
+		case BonusConfirmed, BonusSent:
+			log.Printf("Bonus already accrued, skipping MCRM call: UID=%d, Key=%s, State=%s", sub.UID, key, entry.State)
+			a.confirmBonus(ctx, entry, sub)
+			return nil
+		case BonusPending:
+			log.Printf("Bonus accrual pending reconciliation: UID=%d, Key=%s", sub.UID, key)
+			return nil
+		case BonusFailed:
+			if !resendFailed {
+				log.Printf("Bonus accrual failed earlier, left to its retry: UID=%d, Key=%s", sub.UID, key)
+				return nil
+			}
+		}
+	} else {
+		entry = &BonusLedgerEntry{
+			Key:           key,
+			SubscriberID:  sub.ID,
+			SubscriberUID: sub.UID,
+			CampaignID:    campaign.ID,
+			ListID:        campaign.ListID,
+			Phone:         sub.Phone,
+			Sum:           campaign.BonusSum,
+		}
+	}
+
+	if err := a.saveBonusState(ctx, entry, BonusPending, ""); err != nil {
+		return fmt.Errorf("bonus ledger save error: %v", err)
+	}
+
+	return a.sendBonus(ctx, entry, sub)
+}
+
+// sendBonus performs the accrual for a pending ledger entry, reusing its key so MCRM can drop repeats.
+func (a *App) sendBonus(ctx context.Context, entry *BonusLedgerEntry, sub *SubscriberEntry) error {
+	callCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	resp, err := a.mcrm.AccrueBonus(callCtx, MCRMBonusRequest{Number: entry.Phone, Sum: entry.Sum, IdempotencyKey: entry.Key})
+	cancel()
+	if err != nil {
+		if saveErr := a.saveBonusState(ctx, entry, BonusFailed, err.Error()); saveErr != nil {
+			a.logError("Bonus ledger update error:", saveErr.Error(), entry.SubscriberUID)
+		}
+		return err
+	}
+
+	log.Printf("Bonus accrued in MCRM: UID=%d, Key=%s, Sum=%.2f", entry.SubscriberUID, entry.Key, entry.Sum)
+	bonusesGranted.WithLabelValues(entry.campaignID()).Inc()
+	bonusSumGranted.WithLabelValues(entry.campaignID()).Add(entry.Sum)
+
+	entry.Response = string(resp.Raw)
+	if err := a.saveBonusState(ctx, entry, BonusSent, ""); err != nil {
+		a.logError("Bonus ledger update error:", err.Error(), entry.SubscriberUID)
+		return nil
+	}
+
+	a.confirmBonus(ctx, entry, sub)
+	return nil
+}
+
+func (a *App) confirmBonus(ctx context.Context, entry *BonusLedgerEntry, sub *SubscriberEntry) {
+	if sub.bonusState(entry.campaignID()) != CampaignGranted {
+		if err := a.saveBonusStatus(ctx, sub, entry.campaignID(), CampaignGranted); err != nil {
+			a.logError("Failed to update subscriber bonus status:", err.Error(), sub.UID)
+			return
+		}
+	}
+
+	if entry.State == BonusConfirmed {
+		return
+	}
+	if err := a.saveBonusState(ctx, entry, BonusConfirmed, ""); err != nil {
+		a.logError("Bonus ledger update error:", err.Error(), sub.UID)
+	}
+}
+
+// reconcileBonuses finishes ledger entries left pending or sent by a previous run. Pending
+// accruals are re-sent with their original idempotency key.
+func (a *App) reconcileBonuses(ctx context.Context) {
+	entries, err := listAll(ctx, a.bonuses.ListBonuses, ListOptions{Filter: fmt.Sprintf("state = %s || state = %s", pbQuote(BonusPending), pbQuote(BonusSent))})
+	if err != nil {
+		a.logError("Bonus ledger reconciliation error:", err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+	log.Printf("Reconciling %d bonus ledger entries", len(entries))
+
+	for i := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		entry := &entries[i]
+		sub, err := a.subscribers.GetSubscriberByUID(ctx, entry.SubscriberUID)
+		if err != nil {
+			a.logError("Bonus reconciliation subscriber lookup error:", err.Error(), entry.SubscriberUID)
+			continue
+		}
+
+		if entry.State == BonusSent {
+			a.confirmBonus(ctx, entry, sub)
+			continue
+		}
+
+		if err := a.sendBonus(ctx, entry, sub); err != nil {
+			a.logError("MCRM bonus API error:", fmt.Sprintf("UID: %d, %v", entry.SubscriberUID, err), entry.SubscriberUID)
+			a.addSubscriberRetry(*sub, entry.campaignID(), RetryEventBonus, err.Error())
+		}
+	}
+}
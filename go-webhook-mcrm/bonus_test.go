@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type fakeMCRM struct {
+	MCRMAPI
+	err      error
+	requests []MCRMBonusRequest
+}
+
+func (m *fakeMCRM) AccrueBonus(ctx context.Context, req MCRMBonusRequest) (*MCRMBonusResponse, error) {
+	m.requests = append(m.requests, req)
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &MCRMBonusResponse{Raw: json.RawMessage(`{"ok":true}`)}, nil
+}
+
+// fakeBonusLedger keeps the entries by key and the states every write went through. Updates to
+// failState are rejected.
+type fakeBonusLedger struct {
+	entries   map[string]BonusLedgerEntry
+	states    []string
+	creates   int
+	findErr   error
+	failState string
+}
+
+func newFakeBonusLedger(entries ...BonusLedgerEntry) *fakeBonusLedger {
+	l := &fakeBonusLedger{entries: make(map[string]BonusLedgerEntry)}
+	for _, entry := range entries {
+		l.entries[entry.Key] = entry
+	}
+	return l
+}
+
+func (l *fakeBonusLedger) FindBonus(ctx context.Context, key string) (*BonusLedgerEntry, error) {
+	if l.findErr != nil {
+		return nil, l.findErr
+	}
+	entry, ok := l.entries[key]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return &entry, nil
+}
+
+func (l *fakeBonusLedger) CreateBonus(ctx context.Context, entry *BonusLedgerEntry) error {
+	if _, ok := l.entries[entry.Key]; ok {
+		return fmt.Errorf("duplicate key %s", entry.Key)
+	}
+	l.creates++
+	entry.ID = fmt.Sprintf("ledger%d", l.creates)
+	l.entries[entry.Key] = *entry
+	l.states = append(l.states, entry.State)
+	return nil
+}
+
+func (l *fakeBonusLedger) UpdateBonus(ctx context.Context, entry *BonusLedgerEntry) error {
+	stored, ok := l.entries[entry.Key]
+	if !ok || stored.ID != entry.ID {
+		return ErrRecordNotFound
+	}
+	if entry.State == l.failState {
+		return errors.New("pocketbase unavailable")
+	}
+	l.entries[entry.Key] = *entry
+	l.states = append(l.states, entry.State)
+	return nil
+}
+
+// ListBonuses returns the entries whose state the filter names, ordered by key.
+func (l *fakeBonusLedger) ListBonuses(ctx context.Context, opts ListOptions) (*RecordPage[BonusLedgerEntry], error) {
+	var items []BonusLedgerEntry
+	for _, entry := range l.entries {
+		if strings.Contains(opts.Filter, pbQuote(entry.State)) {
+			items = append(items, entry)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return &RecordPage[BonusLedgerEntry]{Items: items, TotalItems: len(items), TotalPages: 1}, nil
+}
+
+type fakeSubscriberStore struct {
+	SubscriberStore
+	subscribers map[int]*SubscriberEntry
+	updates     int
+}
+
+func (s *fakeSubscriberStore) GetSubscriberByUID(ctx context.Context, uid int) (*SubscriberEntry, error) {
+	sub, ok := s.subscribers[uid]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return sub, nil
+}
+
+func (s *fakeSubscriberStore) UpdateSubscriber(ctx context.Context, sub *SubscriberEntry) error {
+	s.updates++
+	return nil
+}
+
+type fakeLogStore struct{}
+
+func (fakeLogStore) CreateLog(ctx context.Context, entry LogEntry) error { return nil }
+
+func TestGrantBonusLedgerTransitions(t *testing.T) {
+	campaign := CampaignConfig{ID: "spring", ListID: 3, BonusSum: 150}
+	key := bonusKey(42, campaign)
+	stored := func(state string) BonusLedgerEntry {
+		return BonusLedgerEntry{ID: "ledger0", Key: key, SubscriberUID: 42, CampaignID: campaign.ID, ListID: campaign.ListID, Phone: "79990000000", Sum: campaign.BonusSum, State: state}
+	}
+	unavailable := &MCRMError{Kind: MCRMErrorServer, StatusCode: 502}
+
+	tests := []struct {
+		name         string
+		ledger       []BonusLedgerEntry
+		resend       bool
+		mcrmErr      error
+		wantErr      bool
+		wantCalls    int
+		wantStates   []string
+		wantState    string
+		wantCampaign string
+	}{
+		{
+			name:         "new accrual is confirmed",
+			wantCalls:    1,
+			wantStates:   []string{BonusPending, BonusSent, BonusConfirmed},
+			wantState:    BonusConfirmed,
+			wantCampaign: CampaignGranted,
+		},
+		{
+			name:         "failed accrual is recorded for the retry",
+			mcrmErr:      unavailable,
+			wantErr:      true,
+			wantCalls:    1,
+			wantStates:   []string{BonusPending, BonusFailed},
+			wantState:    BonusFailed,
+			wantCampaign: CampaignPending,
+		},
+		{
+			name:         "scheduler leaves a failed accrual to its retry",
+			ledger:       []BonusLedgerEntry{stored(BonusFailed)},
+			wantState:    BonusFailed,
+			wantCampaign: CampaignPending,
+		},
+		{
+			name:         "retry re-sends a failed accrual",
+			ledger:       []BonusLedgerEntry{stored(BonusFailed)},
+			resend:       true,
+			wantCalls:    1,
+			wantStates:   []string{BonusPending, BonusSent, BonusConfirmed},
+			wantState:    BonusConfirmed,
+			wantCampaign: CampaignGranted,
+		},
+		{
+			name:         "retry failing again stays failed",
+			ledger:       []BonusLedgerEntry{stored(BonusFailed)},
+			resend:       true,
+			mcrmErr:      unavailable,
+			wantErr:      true,
+			wantCalls:    1,
+			wantStates:   []string{BonusPending, BonusFailed},
+			wantState:    BonusFailed,
+			wantCampaign: CampaignPending,
+		},
+		{
+			name:         "pending accrual is left to reconciliation",
+			ledger:       []BonusLedgerEntry{stored(BonusPending)},
+			resend:       true,
+			wantState:    BonusPending,
+			wantCampaign: CampaignPending,
+		},
+		{
+			name:         "sent accrual is only confirmed",
+			ledger:       []BonusLedgerEntry{stored(BonusSent)},
+			wantStates:   []string{BonusConfirmed},
+			wantState:    BonusConfirmed,
+			wantCampaign: CampaignGranted,
+		},
+		{
+			name:         "confirmed accrual only updates the subscriber",
+			ledger:       []BonusLedgerEntry{stored(BonusConfirmed)},
+			wantState:    BonusConfirmed,
+			wantCampaign: CampaignGranted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mcrm := &fakeMCRM{err: tt.mcrmErr}
+			ledger := newFakeBonusLedger(tt.ledger...)
+			a := &App{mcrm: mcrm, bonuses: ledger, subscribers: &fakeSubscriberStore{}, logs: fakeLogStore{}}
+			sub := &SubscriberEntry{ID: "sub1", UID: 42, Phone: "79990000000", Bonuses: map[string]string{campaign.ID: CampaignPending}}
+
+			var err error
+			if tt.resend {
+				err = a.resendBonus(context.Background(), sub, campaign)
+			} else {
+				err = a.grantBonus(context.Background(), sub, campaign)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+
+			if len(mcrm.requests) != tt.wantCalls {
+				t.Fatalf("MCRM accruals = %d, want %d", len(mcrm.requests), tt.wantCalls)
+			}
+			for _, req := range mcrm.requests {
+				if req.IdempotencyKey != key || req.Number != sub.Phone || req.Sum != campaign.BonusSum {
+					t.Errorf("accrual request = %+v, want key %s for %s", req, key, sub.Phone)
+				}
+			}
+			if !reflect.DeepEqual(ledger.states, tt.wantStates) {
+				t.Errorf("ledger writes = %v, want %v", ledger.states, tt.wantStates)
+			}
+			if len(tt.ledger) > 0 && ledger.creates > 0 {
+				t.Errorf("existing ledger entry was created again")
+			}
+			if got := ledger.entries[key].State; got != tt.wantState {
+				t.Errorf("ledger state = %q, want %q", got, tt.wantState)
+			}
+			if got := sub.bonusState(campaign.ID); got != tt.wantCampaign {
+				t.Errorf("subscriber bonus = %q, want %q", got, tt.wantCampaign)
+			}
+		})
+	}
+}
+
+func TestGrantBonusLedgerErrors(t *testing.T) {
+	campaign := CampaignConfig{ID: "spring", ListID: 3, BonusSum: 150}
+	mcrm := &fakeMCRM{}
+	a := &App{mcrm: mcrm, bonuses: &fakeBonusLedger{findErr: errors.New("pocketbase unavailable")}, subscribers: &fakeSubscriberStore{}, logs: fakeLogStore{}}
+	sub := &SubscriberEntry{UID: 42, Phone: "79990000000", Bonuses: map[string]string{campaign.ID: CampaignPending}}
+
+	if err := a.grantBonus(context.Background(), sub, campaign); err == nil {
+		t.Fatal("grantBonus() = nil, want the ledger error")
+	}
+	if len(mcrm.requests) != 0 {
+		t.Fatalf("MCRM accruals = %d without a ledger entry, want 0", len(mcrm.requests))
+	}
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatalf("read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestSendBonusCountsAccrualWhenLedgerWriteFails(t *testing.T) {
+	campaign := CampaignConfig{ID: "metrics", ListID: 3, BonusSum: 150}
+	ledger := newFakeBonusLedger()
+	ledger.failState = BonusSent
+	mcrm := &fakeMCRM{}
+	a := &App{mcrm: mcrm, bonuses: ledger, subscribers: &fakeSubscriberStore{}, logs: fakeLogStore{}}
+	sub := &SubscriberEntry{UID: 42, Phone: "79990000000", Bonuses: map[string]string{campaign.ID: CampaignPending}}
+
+	granted := counterValue(t, bonusesGranted.WithLabelValues(campaign.ID))
+	sum := counterValue(t, bonusSumGranted.WithLabelValues(campaign.ID))
+	if err := a.grantBonus(context.Background(), sub, campaign); err != nil {
+		t.Fatalf("grantBonus() = %v", err)
+	}
+	if len(mcrm.requests) != 1 || ledger.entries[bonusKey(42, campaign)].State != BonusPending {
+		t.Fatalf("accruals = %d, ledger = %+v, want one accrual left pending", len(mcrm.requests), ledger.entries)
+	}
+	if got := counterValue(t, bonusesGranted.WithLabelValues(campaign.ID)) - granted; got != 1 {
+		t.Errorf("bonuses granted += %v, want 1", got)
+	}
+	if got := counterValue(t, bonusSumGranted.WithLabelValues(campaign.ID)) - sum; got != campaign.BonusSum {
+		t.Errorf("bonus sum granted += %v, want %v", got, campaign.BonusSum)
+	}
+}
+
+func TestBonusKeyPerCampaign(t *testing.T) {
+	tests := []struct {
+		campaign CampaignConfig
+		want     string
+	}{
+		{campaign: CampaignConfig{ID: defaultCampaignID, ListID: 3}, want: "bonus-42-3"},
+		{campaign: CampaignConfig{ID: "spring", ListID: 3}, want: "bonus-42-spring"},
+		{campaign: CampaignConfig{ID: "autumn", ListID: 3}, want: "bonus-42-autumn"},
+	}
+	for _, tt := range tests {
+		if got := bonusKey(42, tt.campaign); got != tt.want {
+			t.Errorf("bonusKey(42, %s) = %q, want %q", tt.campaign.ID, got, tt.want)
+		}
+	}
+}
+
+func TestReconcileBonuses(t *testing.T) {
+	entry := func(uid int, campaign, state string) BonusLedgerEntry {
+		return BonusLedgerEntry{ID: fmt.Sprintf("ledger-%d-%s", uid, campaign), Key: bonusKey(uid, CampaignConfig{ID: campaign, ListID: 3}),
+			SubscriberUID: uid, CampaignID: campaign, ListID: 3, Phone: fmt.Sprintf("7999000000%d", uid), Sum: 150, State: state}
+	}
+	pending := entry(1, "spring", BonusPending)
+	sent := entry(2, "spring", BonusSent)
+	confirmed := entry(3, "spring", BonusConfirmed)
+	otherCampaign := entry(1, "autumn", BonusSent)
+
+	tests := []struct {
+		name        string
+		mcrmErr     error
+		wantCalls   []string
+		wantStates  map[string]string
+		wantGranted map[int]string
+		wantRetries int
+	}{
+		{
+			name:      "pending is re-sent with its key and sent is only confirmed",
+			wantCalls: []string{pending.Key},
+			wantStates: map[string]string{
+				pending.Key: BonusConfirmed, sent.Key: BonusConfirmed, confirmed.Key: BonusConfirmed, otherCampaign.Key: BonusConfirmed,
+			},
+			wantGranted: map[int]string{1: CampaignGranted, 2: CampaignGranted, 3: CampaignGranted},
+		},
+		{
+			name:      "failed re-send is handed to the retry queue",
+			mcrmErr:   &MCRMError{Kind: MCRMErrorServer, StatusCode: 502},
+			wantCalls: []string{pending.Key},
+			wantStates: map[string]string{
+				pending.Key: BonusFailed, sent.Key: BonusConfirmed, confirmed.Key: BonusConfirmed, otherCampaign.Key: BonusConfirmed,
+			},
+			wantGranted: map[int]string{1: CampaignPending, 2: CampaignGranted, 3: CampaignGranted},
+			wantRetries: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subscribers := make(map[int]*SubscriberEntry)
+			for uid := 1; uid <= 3; uid++ {
+				state := CampaignPending
+				if uid == 3 {
+					state = CampaignGranted
+				}
+				subscribers[uid] = &SubscriberEntry{ID: fmt.Sprintf("sub%d", uid), UID: uid, Phone: fmt.Sprintf("7999000000%d", uid),
+					Bonuses: map[string]string{"spring": state, "autumn": CampaignGranted}}
+			}
+			mcrm := &fakeMCRM{err: tt.mcrmErr}
+			ledger := newFakeBonusLedger(pending, sent, confirmed, otherCampaign)
+			retries := &fakeRetryStore{}
+			a := &App{mcrm: mcrm, bonuses: ledger, retries: retries, subscribers: &fakeSubscriberStore{subscribers: subscribers}, logs: fakeLogStore{}}
+
+			a.reconcileBonuses(context.Background())
+
+			var calls []string
+			for _, req := range mcrm.requests {
+				calls = append(calls, req.IdempotencyKey)
+			}
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("MCRM accruals = %v, want %v", calls, tt.wantCalls)
+			}
+			for key, want := range tt.wantStates {
+				if got := ledger.entries[key].State; got != want {
+					t.Errorf("ledger %s = %q, want %q", key, got, want)
+				}
+			}
+			for uid, want := range tt.wantGranted {
+				if got := subscribers[uid].bonusState("spring"); got != want {
+					t.Errorf("subscriber %d spring bonus = %q, want %q", uid, got, want)
+				}
+			}
+			if len(retries.entries) != tt.wantRetries {
+				t.Fatalf("retries = %d, want %d", len(retries.entries), tt.wantRetries)
+			}
+			if tt.wantRetries > 0 {
+				if got := retries.entries[0]; got.Event != RetryEventBonus || got.SubscriberUID != 1 || got.CampaignID != "spring" {
+					t.Errorf("retry entry = %+v, want a spring bonus retry for UID 1", got)
+				}
+			}
+		})
+	}
+}
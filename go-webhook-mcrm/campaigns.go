@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Per-campaign bonus states kept in SubscriberEntry.Bonuses.
+const (
+	CampaignPending = "pending"
+	CampaignGranted = "granted"
+	CampaignExpired = "expired"
+	// CampaignCancelled is set by reconciliation when the subscriber left the campaign list
+	// or was blocklisted before the bonus was granted, and for campaigns marked retired.
+	CampaignCancelled = "cancelled"
+)
+
+// defaultCampaignID names the campaign built from LIST_ID and BONUS_SUM. Subscribers saved
+// before campaigns existed only carry BonusStatus and are treated as enrolled in it.
+const defaultCampaignID = "default"
+
+// CampaignConfig is one bonus campaign. Retired stops the campaign for good: its pending bonuses
+// are cancelled. A campaign missing from the config is only skipped, so a typo cancels nothing.
+type CampaignConfig struct {
+	ID             string    `yaml:"id"`
+	ListID         int       `yaml:"list_id"`
+	BonusSum       float64   `yaml:"bonus_sum"`
+	RequiredStatus string    `yaml:"required_status"`
+	Events         []string  `yaml:"events"`
+	StartsAt       time.Time `yaml:"starts_at"`
+	EndsAt         time.Time `yaml:"ends_at"`
+	Retired        bool      `yaml:"retired"`
+}
+
+func (c CampaignConfig) Started(now time.Time) bool {
+	return c.StartsAt.IsZero() || !now.Before(c.StartsAt)
+}
+
+func (c CampaignConfig) Ended(now time.Time) bool {
+	return !c.EndsAt.IsZero() && now.After(c.EndsAt)
+}
+
+func (c CampaignConfig) Active(now time.Time) bool {
+	return c.Started(now) && !c.Ended(now) && !c.Retired
+}
+
+// MatchesEvent reports whether a webhook event enrolls subscribers, an empty filter accepts every event.
+func (c CampaignConfig) MatchesEvent(event string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, e := range c.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *App) campaign(id string) (CampaignConfig, bool) {
+	if id == "" {
+		id = defaultCampaignID
+	}
+	for _, c := range a.config.Campaigns {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return CampaignConfig{}, false
+}
+
+func (a *App) campaignsForEvent(event string, now time.Time) []CampaignConfig {
+	var campaigns []CampaignConfig
+	for _, c := range a.config.Campaigns {
+		if c.Active(now) && c.MatchesEvent(event) {
+			campaigns = append(campaigns, c)
+		}
+	}
+	return campaigns
+}
+
+func (a *App) campaignsForList(listID int, now time.Time) []CampaignConfig {
+	var campaigns []CampaignConfig
+	for _, c := range a.config.Campaigns {
+		if c.Active(now) && c.ListID == listID {
+			campaigns = append(campaigns, c)
+		}
+	}
+	return campaigns
+}
+
+// activeListIDs returns the distinct Listmonk lists of the campaigns running at now.
+func (a *App) activeListIDs(now time.Time) []int {
+	seen := make(map[int]bool)
+	var listIDs []int
+	for _, c := range a.config.Campaigns {
+		if c.Active(now) && !seen[c.ListID] {
+			seen[c.ListID] = true
+			listIDs = append(listIDs, c.ListID)
+		}
+	}
+	return listIDs
+}
+
+func campaignListIDs(campaigns []CampaignConfig) []int {
+	seen := make(map[int]bool)
+	var listIDs []int
+	for _, c := range campaigns {
+		if !seen[c.ListID] {
+			seen[c.ListID] = true
+			listIDs = append(listIDs, c.ListID)
+		}
+	}
+	return listIDs
+}
+
+// pendingCampaigns returns the IDs of the campaigns the subscriber still waits for a bonus from.
+func (s *SubscriberEntry) pendingCampaigns() []string {
+	if s.Bonuses == nil {
+		if s.BonusStatus {
+			return nil
+		}
+		return []string{defaultCampaignID}
+	}
+	var ids []string
+	for id, state := range s.Bonuses {
+		if state == CampaignPending {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (s *SubscriberEntry) bonusState(campaignID string) string {
+	if s.Bonuses == nil {
+		if campaignID != defaultCampaignID {
+			return ""
+		}
+		if s.BonusStatus {
+			return CampaignGranted
+		}
+		return CampaignPending
+	}
+	return s.Bonuses[campaignID]
+}
+
+// setBonusState records the campaign state and keeps BonusStatus as "nothing left pending",
+// so the subscription scheduler can still filter on bonus_status.
+func (s *SubscriberEntry) setBonusState(campaignID, state string) {
+	if s.Bonuses == nil {
+		s.Bonuses = make(map[string]string)
+		if !s.BonusStatus {
+			s.Bonuses[defaultCampaignID] = CampaignPending
+		} else {
+			s.Bonuses[defaultCampaignID] = CampaignGranted
+		}
+	}
+	s.Bonuses[campaignID] = state
+	s.BonusStatus = len(s.pendingCampaigns()) == 0
+}
+
+// enroll marks the subscriber as pending for every campaign it has no state for yet,
+// reporting whether anything changed.
+func (s *SubscriberEntry) enroll(campaigns []CampaignConfig) bool {
+	changed := false
+	for _, c := range campaigns {
+		if s.bonusState(c.ID) == "" {
+			s.setBonusState(c.ID, CampaignPending)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (a *App) saveBonusStatus(ctx context.Context, sub *SubscriberEntry, campaignID, state string) error {
+	sub.setBonusState(campaignID, state)
+	if err := a.subscribers.UpdateSubscriber(ctx, sub); err != nil {
+		return err
+	}
+	log.Printf("Updated subscriber in PocketBase: UID=%d, Campaign=%s, Bonus=%s", sub.UID, campaignID, state)
+	return nil
+}
+
+// hasRequiredStatus reports whether the subscriber's status on the campaign list is the one the campaign asks for.
+func (a *App) hasRequiredStatus(ctx context.Context, uid int, campaign CampaignConfig) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	status, err := a.listmonk.SubscriptionStatus(ctx, uid, campaign.ListID)
+	if err != nil {
+		return false, err
+	}
+	return status == campaign.RequiredStatus, nil
+}
+
+// checkCampaigns refreshes the subscriber's Listmonk status, evaluates every campaign it is
+// pending for and grants the bonuses whose subscription requirement is met. Pending bonuses of
+// blocklisted subscribers and of retired campaigns are cancelled, which takes them out of the
+// polling.
+func (a *App) checkCampaigns(ctx context.Context, sub *SubscriberEntry) {
+	now := time.Now()
+	pending := sub.pendingCampaigns()
+	if len(pending) == 0 {
+		return
+	}
+
+	// One Listmonk lookup per check keeps the stored status current for every pending campaign.
+	refreshErr := a.refreshSubscriberStatus(ctx, sub)
+	if refreshErr == nil {
+		if sub.blocklisted() {
+			for _, id := range pending {
+				sub.setBonusState(id, CampaignCancelled)
+			}
+			log.Printf("Subscriber is blocklisted, cancelling pending bonuses: UID=%d, Campaigns=%v", sub.UID, pending)
+		}
+		if err := a.subscribers.UpdateSubscriber(ctx, sub); err != nil {
+			a.logError("Failed to update subscriber status:", err.Error(), sub.UID)
+		}
+		if sub.blocklisted() {
+			return
+		}
+	}
+
+	for _, id := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+
+		campaign, ok := a.campaign(id)
+		if !ok {
+			log.Printf("Skipping unknown campaign: UID=%d, Campaign=%s", sub.UID, id)
+			continue
+		}
+		if campaign.Retired {
+			log.Printf("Cancelling bonus of retired campaign: UID=%d, Campaign=%s", sub.UID, id)
+			if err := a.saveBonusStatus(ctx, sub, campaign.ID, CampaignCancelled); err != nil {
+				a.logError("Failed to update subscriber bonus status:", err.Error(), sub.UID)
+			}
+			continue
+		}
+		if campaign.Ended(now) {
+			if err := a.saveBonusStatus(ctx, sub, campaign.ID, CampaignExpired); err != nil {
+				a.logError("Failed to update subscriber bonus status:", err.Error(), sub.UID)
+			}
+			continue
+		}
+		if !campaign.Started(now) {
+			continue
+		}
+
+		if refreshErr != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			a.logError("Listmonk GET API error:", fmt.Sprintf("UID: %d, Campaign: %s, %v", sub.UID, campaign.ID, refreshErr), sub.UID)
+			a.addSubscriberRetry(*sub, campaign.ID, RetryEventCheckSubscription, refreshErr.Error())
+			continue
+		}
+		if sub.listStatus(campaign.ListID) != campaign.RequiredStatus {
+			continue
+		}
+
+		if err := a.grantBonus(ctx, sub, campaign); err != nil {
+			a.logError("MCRM bonus API error:", fmt.Sprintf("UID: %d, Campaign: %s, %v", sub.UID, campaign.ID, err), sub.UID)
+			a.addSubscriberRetry(*sub, campaign.ID, RetryEventBonus, err.Error())
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type fakeListmonk struct {
+	ListmonkAPI
+	status string
+}
+
+func (l *fakeListmonk) GetSubscriber(ctx context.Context, id int) (*ListmonkGetResponse, error) {
+	resp := &ListmonkGetResponse{}
+	resp.Data.ID = id
+	resp.Data.Status = l.status
+	return resp, nil
+}
+
+func (l *fakeListmonk) SubscriberBounces(ctx context.Context, subscriberID int) (int, error) {
+	return 0, nil
+}
+
+func TestCheckCampaignsBonusStates(t *testing.T) {
+	now := time.Now()
+	campaigns := []CampaignConfig{
+		{ID: "spring", ListID: 3, BonusSum: 100, RequiredStatus: SubscriptionConfirmed},
+		{ID: "winter", ListID: 4, BonusSum: 100, RequiredStatus: SubscriptionConfirmed, EndsAt: now.Add(-time.Hour)},
+		{ID: "summer", ListID: 5, BonusSum: 100, RequiredStatus: SubscriptionConfirmed, Retired: true},
+	}
+
+	tests := []struct {
+		name    string
+		status  string
+		bonuses map[string]string
+		want    map[string]string
+	}{
+		{
+			name:    "unknown campaign stays pending",
+			status:  "enabled",
+			bonuses: map[string]string{"spring": CampaignPending, "typo": CampaignPending},
+			want:    map[string]string{"spring": CampaignPending, "typo": CampaignPending},
+		},
+		{
+			name:    "legacy default without a default campaign stays pending",
+			status:  "enabled",
+			bonuses: nil,
+			want:    map[string]string{defaultCampaignID: CampaignPending},
+		},
+		{
+			name:    "ended campaign expires",
+			status:  "enabled",
+			bonuses: map[string]string{"winter": CampaignPending},
+			want:    map[string]string{"winter": CampaignExpired},
+		},
+		{
+			name:    "retired campaign is cancelled",
+			status:  "enabled",
+			bonuses: map[string]string{"summer": CampaignPending, "spring": CampaignPending},
+			want:    map[string]string{"summer": CampaignCancelled, "spring": CampaignPending},
+		},
+		{
+			name:    "blocklisted subscriber is cancelled everywhere",
+			status:  SubscriberBlocklisted,
+			bonuses: map[string]string{"spring": CampaignPending, "typo": CampaignPending, "winter": CampaignGranted},
+			want:    map[string]string{"spring": CampaignCancelled, "typo": CampaignCancelled, "winter": CampaignGranted},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &App{
+				config:      &Config{Campaigns: campaigns},
+				listmonk:    &fakeListmonk{status: tt.status},
+				subscribers: &fakeSubscriberStore{},
+				logs:        fakeLogStore{},
+			}
+			sub := &SubscriberEntry{ID: "sub1", UID: 42, Bonuses: tt.bonuses}
+
+			a.checkCampaigns(context.Background(), sub)
+
+			for id, want := range tt.want {
+				if got := sub.bonusState(id); got != want {
+					t.Errorf("bonus %s = %q, want %q", id, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+type MCRMConfig struct {
+	UserURL  string `yaml:"user_url"`
+	BonusURL string `yaml:"bonus_url"`
+	APIKey   string `yaml:"api_key"`
+}
+
+type ListmonkConfig struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	APIKey   string `yaml:"api_key"`
+}
+
+// PocketBaseConfig authenticates with superuser Email and Password when both are set,
+// AdminToken is only used as a static fallback.
+type PocketBaseConfig struct {
+	URL        string `yaml:"url"`
+	Email      string `yaml:"email"`
+	Password   string `yaml:"password"`
+	AdminToken string `yaml:"admin_token"`
+}
+
+// WebhookConfig enables HMAC signature verification when SigningSecrets is not empty.
+type WebhookConfig struct {
+	Username           string        `yaml:"username"`
+	Password           string        `yaml:"password"`
+	QueueSize          int           `yaml:"queue_size"`
+	Workers            int           `yaml:"workers"`
+	SigningSecrets     []string      `yaml:"signing_secrets"`
+	SignatureTolerance time.Duration `yaml:"signature_tolerance"`
+}
+
+type RetryConfig struct {
+	BackoffBase   time.Duration `yaml:"backoff_base"`
+	BackoffFactor float64       `yaml:"backoff_factor"`
+	BackoffMax    time.Duration `yaml:"backoff_max"`
+	BackoffJitter float64       `yaml:"backoff_jitter"`
+}
+
+type ScheduleConfig struct {
+	SyncInterval  time.Duration `yaml:"sync_interval"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+	CheckDebounce time.Duration `yaml:"check_debounce"`
+}
+
+// Config is loaded once at startup from defaults, an optional YAML file (CONFIG_FILE)
+// and the environment, in that order of precedence. Campaigns can only be set in the file,
+// without them LIST_ID and BONUS_SUM form the single default campaign.
+type Config struct {
+	ListID          int               `yaml:"list_id"`
+	BonusSum        float64           `yaml:"bonus_sum"`
+	ListenAddr      string            `yaml:"listen_addr"`
+	ShutdownTimeout time.Duration     `yaml:"shutdown_timeout"`
+	MCRM            MCRMConfig        `yaml:"mcrm"`
+	Listmonk        ListmonkConfig    `yaml:"listmonk"`
+	PocketBase      PocketBaseConfig  `yaml:"pocketbase"`
+	Webhook         WebhookConfig     `yaml:"webhook"`
+	Retry           RetryConfig       `yaml:"retry"`
+	Schedule        ScheduleConfig    `yaml:"schedule"`
+	Campaigns       []CampaignConfig  `yaml:"campaigns"`
+	Events          map[string]string `yaml:"events"`
+	Mapping         FieldMapping      `yaml:"mapping"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Mapping:         defaultFieldMapping(),
+		ListenAddr:      ":8080",
+		ShutdownTimeout: 30 * time.Second,
+		Webhook: WebhookConfig{
+			QueueSize:          1000,
+			Workers:            4,
+			SignatureTolerance: 5 * time.Minute,
+		},
+		Retry: RetryConfig{
+			BackoffBase:   30 * time.Second,
+			BackoffFactor: 2,
+			BackoffMax:    1 * time.Hour,
+			BackoffJitter: 0.2,
+		},
+		Schedule: ScheduleConfig{
+			SyncInterval:  1 * time.Hour,
+			CheckInterval: 15 * time.Minute,
+			CheckDebounce: 30 * time.Second,
+		},
+	}
+}
+
+// LoadConfig reads .env when present, then the YAML file named by CONFIG_FILE, then the
+// environment. Every invalid or missing value is reported in the returned error.
+func LoadConfig() (*Config, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error loading .env file: %v", err)
+	}
+
+	cfg := defaultConfig()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config file: %v", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("error parsing config file %s: %v", path, err)
+		}
+	}
+
+	env := &envReader{}
+	env.int("LIST_ID", &cfg.ListID)
+	env.float("BONUS_SUM", &cfg.BonusSum)
+	env.string("LISTEN_ADDR", &cfg.ListenAddr)
+	env.duration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout)
+
+	env.string("MCRM_API_URL_USER", &cfg.MCRM.UserURL)
+	env.string("MCRM_API_URL_BONUS", &cfg.MCRM.BonusURL)
+	env.string("MCRM_API_KEY", &cfg.MCRM.APIKey)
+
+	env.string("LISTMONK_API_URL", &cfg.Listmonk.URL)
+	env.string("LISTMONK_USERNAME", &cfg.Listmonk.Username)
+	env.string("LISTMONK_API_KEY", &cfg.Listmonk.APIKey)
+
+	env.string("POCKETBASE_URL", &cfg.PocketBase.URL)
+	env.string("POCKETBASE_ADMIN_EMAIL", &cfg.PocketBase.Email)
+	env.string("POCKETBASE_ADMIN_PASSWORD", &cfg.PocketBase.Password)
+	env.string("POCKETBASE_ADMIN_TOKEN", &cfg.PocketBase.AdminToken)
+
+	env.string("WEBHOOK_USERNAME", &cfg.Webhook.Username)
+	env.string("WEBHOOK_PASSWORD", &cfg.Webhook.Password)
+	env.int("WEBHOOK_QUEUE_SIZE", &cfg.Webhook.QueueSize)
+	env.int("WEBHOOK_WORKERS", &cfg.Webhook.Workers)
+	env.list("WEBHOOK_SIGNING_SECRETS", &cfg.Webhook.SigningSecrets)
+	env.duration("WEBHOOK_SIGNATURE_TOLERANCE", &cfg.Webhook.SignatureTolerance)
+	env.mapping("WEBHOOK_EVENT_ACTIONS", &cfg.Events)
+
+	env.duration("RETRY_BACKOFF_BASE", &cfg.Retry.BackoffBase)
+	env.float("RETRY_BACKOFF_FACTOR", &cfg.Retry.BackoffFactor)
+	env.duration("RETRY_BACKOFF_MAX", &cfg.Retry.BackoffMax)
+	env.float("RETRY_BACKOFF_JITTER", &cfg.Retry.BackoffJitter)
+
+	env.duration("LISTMONK_SYNC_INTERVAL", &cfg.Schedule.SyncInterval)
+	env.duration("SUBSCRIPTION_CHECK_INTERVAL", &cfg.Schedule.CheckInterval)
+	env.duration("SUBSCRIPTION_CHECK_DEBOUNCE", &cfg.Schedule.CheckDebounce)
+
+	for i := range cfg.Campaigns {
+		if cfg.Campaigns[i].RequiredStatus == "" {
+			cfg.Campaigns[i].RequiredStatus = "confirmed"
+		}
+	}
+
+	if err := errors.Join(append(env.errs, cfg.Validate())...); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Events) == 0 {
+		cfg.Events = defaultEventRoutes()
+	}
+	if len(cfg.Campaigns) == 0 {
+		cfg.Campaigns = []CampaignConfig{{
+			ID:             defaultCampaignID,
+			ListID:         cfg.ListID,
+			BonusSum:       cfg.BonusSum,
+			RequiredStatus: "confirmed",
+		}}
+	}
+	return &cfg, nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	required := func(name, value string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+	validURL := func(name, value string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+			return
+		}
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s is not an absolute URL: %q", name, value))
+		}
+	}
+	positive := func(name string, ok bool) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		}
+	}
+
+	if len(c.Campaigns) == 0 {
+		positive("LIST_ID", c.ListID > 0)
+		positive("BONUS_SUM", c.BonusSum > 0)
+	}
+	seen := make(map[string]bool)
+	for i, campaign := range c.Campaigns {
+		name := fmt.Sprintf("campaigns[%d]", i)
+		if campaign.ID == "" {
+			errs = append(errs, fmt.Errorf("%s: id is required", name))
+		} else if seen[campaign.ID] {
+			errs = append(errs, fmt.Errorf("%s: duplicate id %q", name, campaign.ID))
+		}
+		seen[campaign.ID] = true
+		positive(name+".list_id", campaign.ListID > 0)
+		positive(name+".bonus_sum", campaign.BonusSum > 0)
+		switch campaign.RequiredStatus {
+		case "confirmed", "unconfirmed":
+		default:
+			errs = append(errs, fmt.Errorf("%s: required_status must be confirmed or unconfirmed, got %q", name, campaign.RequiredStatus))
+		}
+		if !campaign.StartsAt.IsZero() && !campaign.EndsAt.IsZero() && !campaign.EndsAt.After(campaign.StartsAt) {
+			errs = append(errs, fmt.Errorf("%s: ends_at must be after starts_at", name))
+		}
+	}
+	for event, action := range c.Events {
+		switch action {
+		case ActionSignup, ActionUpdateAttribs, ActionUnsubscribe, ActionBlocklist, ActionTag:
+		default:
+			errs = append(errs, fmt.Errorf("events.%s: unknown action %q", event, action))
+		}
+	}
+	if _, err := NewSubscriberMapper(c.Mapping); err != nil {
+		errs = append(errs, err)
+	}
+	required("LISTEN_ADDR", c.ListenAddr)
+	positive("SHUTDOWN_TIMEOUT", c.ShutdownTimeout > 0)
+
+	validURL("MCRM_API_URL_USER", c.MCRM.UserURL)
+	validURL("MCRM_API_URL_BONUS", c.MCRM.BonusURL)
+	required("MCRM_API_KEY", c.MCRM.APIKey)
+
+	validURL("LISTMONK_API_URL", c.Listmonk.URL)
+	required("LISTMONK_USERNAME", c.Listmonk.Username)
+	required("LISTMONK_API_KEY", c.Listmonk.APIKey)
+
+	validURL("POCKETBASE_URL", c.PocketBase.URL)
+	switch {
+	case c.PocketBase.Email != "" && c.PocketBase.Password == "":
+		errs = append(errs, fmt.Errorf("POCKETBASE_ADMIN_PASSWORD is required with POCKETBASE_ADMIN_EMAIL"))
+	case c.PocketBase.Email == "" && c.PocketBase.Password != "":
+		errs = append(errs, fmt.Errorf("POCKETBASE_ADMIN_EMAIL is required with POCKETBASE_ADMIN_PASSWORD"))
+	case c.PocketBase.Email == "" && c.PocketBase.AdminToken == "":
+		errs = append(errs, fmt.Errorf("POCKETBASE_ADMIN_EMAIL and POCKETBASE_ADMIN_PASSWORD (or POCKETBASE_ADMIN_TOKEN) are required"))
+	}
+
+	required("WEBHOOK_USERNAME", c.Webhook.Username)
+	required("WEBHOOK_PASSWORD", c.Webhook.Password)
+	positive("WEBHOOK_QUEUE_SIZE", c.Webhook.QueueSize > 0)
+	positive("WEBHOOK_WORKERS", c.Webhook.Workers > 0)
+	positive("WEBHOOK_SIGNATURE_TOLERANCE", c.Webhook.SignatureTolerance > 0)
+	for i, secret := range c.Webhook.SigningSecrets {
+		if secret == "" {
+			errs = append(errs, fmt.Errorf("WEBHOOK_SIGNING_SECRETS[%d] is empty", i))
+		}
+	}
+
+	positive("RETRY_BACKOFF_BASE", c.Retry.BackoffBase > 0)
+	if c.Retry.BackoffFactor < 1 {
+		errs = append(errs, fmt.Errorf("RETRY_BACKOFF_FACTOR must be at least 1"))
+	}
+	if c.Retry.BackoffMax < c.Retry.BackoffBase {
+		errs = append(errs, fmt.Errorf("RETRY_BACKOFF_MAX must not be lower than RETRY_BACKOFF_BASE"))
+	}
+	if c.Retry.BackoffJitter < 0 || c.Retry.BackoffJitter > 1 {
+		errs = append(errs, fmt.Errorf("RETRY_BACKOFF_JITTER must be between 0 and 1"))
+	}
+
+	positive("LISTMONK_SYNC_INTERVAL", c.Schedule.SyncInterval > 0)
+	positive("SUBSCRIPTION_CHECK_INTERVAL", c.Schedule.CheckInterval > 0)
+	positive("SUBSCRIPTION_CHECK_DEBOUNCE", c.Schedule.CheckDebounce > 0)
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) Backoff() BackoffPolicy {
+	return BackoffPolicy{
+		Base:   c.Retry.BackoffBase,
+		Factor: c.Retry.BackoffFactor,
+		Max:    c.Retry.BackoffMax,
+		Jitter: c.Retry.BackoffJitter,
+	}
+}
+
+// envReader overrides config values with set environment variables and collects parse errors.
+type envReader struct {
+	errs []error
+}
+
+func (r *envReader) string(name string, dst *string) {
+	if value, ok := os.LookupEnv(name); ok {
+		*dst = value
+	}
+}
+
+// list splits a comma separated variable, ignoring surrounding whitespace.
+func (r *envReader) list(name string, dst *[]string) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		items = append(items, strings.TrimSpace(item))
+	}
+	*dst = items
+}
+
+// mapping parses "key=value" pairs separated by commas.
+func (r *envReader) mapping(name string, dst *map[string]string) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return
+	}
+	pairs := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		key, val, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found || key == "" {
+			r.errs = append(r.errs, fmt.Errorf("%s: invalid pair %q, expected key=value", name, item))
+			continue
+		}
+		pairs[key] = val
+	}
+	*dst = pairs
+}
+
+func (r *envReader) int(name string, dst *int) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("%s: invalid integer %q", name, value))
+		return
+	}
+	*dst = parsed
+}
+
+func (r *envReader) float(name string, dst *float64) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("%s: invalid number %q", name, value))
+		return
+	}
+	*dst = parsed
+}
+
+func (r *envReader) duration(name string, dst *time.Duration) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		r.errs = append(r.errs, fmt.Errorf("%s: invalid duration %q", name, value))
+		return
+	}
+	*dst = parsed
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type DeadLetter struct {
+	ID            string         `json:"id"`
+	RetryID       string         `json:"retry_id"`
+	Serial        string         `json:"serial"`
+	Event         string         `json:"event"`
+	SubscriberUID int            `json:"subscriber_uid"`
+	Payload       RetryEntry     `json:"payload"`
+	Attempts      []RetryAttempt `json:"attempts"`
+	RetryCount    int            `json:"retry_count"`
+	LastError     string         `json:"last_error"`
+	FailedAt      string         `json:"failed_at"`
+}
+
+type DeadLetterStore interface {
+	CreateDeadLetter(ctx context.Context, letter *DeadLetter) error
+	GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error)
+	DeleteDeadLetter(ctx context.Context, id string) error
+	ListDeadLetters(ctx context.Context, opts ListOptions) (*RecordPage[DeadLetter], error)
+}
+
+// moveToDeadLetter parks an exhausted retry entry, the entry is only deleted once the dead letter is stored.
+func (a *App) moveToDeadLetter(ctx context.Context, entry RetryEntry) {
+	letter := DeadLetter{
+		RetryID:       entry.ID,
+		Serial:        entry.Serial,
+		Event:         entry.Event,
+		SubscriberUID: entry.SubscriberUID,
+		Payload:       entry,
+		Attempts:      entry.Attempts,
+		RetryCount:    entry.RetryCount,
+		LastError:     entry.LastError,
+		FailedAt:      time.Now().Format(time.RFC3339),
+	}
+	if err := a.deadLetters.CreateDeadLetter(ctx, &letter); err != nil {
+		a.logError("Dead letter save error:", err.Error())
+		return
+	}
+	log.Printf("Moved retry entry to dead letters: ID=%s, Serial=%s, Event=%s", letter.ID, entry.Serial, entry.Event)
+	deadLettersTotal.WithLabelValues(entry.Event).Inc()
+	a.deleteRetryEntry(ctx, entry)
+}
+
+func (a *App) listDeadLetters(c echo.Context) error {
+	opts := ListOptions{Sort: "-failed_at"}
+	opts.Page, _ = strconv.Atoi(c.QueryParam("page"))
+	opts.PerPage, _ = strconv.Atoi(c.QueryParam("perPage"))
+	if event := c.QueryParam("event"); event != "" {
+		opts.Filter = "event = " + pbQuote(event)
+	}
+
+	page, err := a.deadLetters.ListDeadLetters(c.Request().Context(), opts)
+	if err != nil {
+		a.logError("Dead letter list error:", err.Error())
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+func (a *App) getDeadLetter(c echo.Context) error {
+	letter, err := a.deadLetters.GetDeadLetter(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return a.deadLetterError(c, err)
+	}
+	return c.JSON(http.StatusOK, letter)
+}
+
+func (a *App) requeueDeadLetter(c echo.Context) error {
+	ctx := c.Request().Context()
+	letter, err := a.deadLetters.GetDeadLetter(ctx, c.Param("id"))
+	if err != nil {
+		return a.deadLetterError(c, err)
+	}
+
+	entry := letter.Payload
+	entry.ID = ""
+	entry.RetryCount = 0
+	entry.NextAttemptAt = time.Now().UTC().Format(pbDateTime)
+	entry.Timestamp = time.Now().Format(time.RFC3339)
+	if err := a.retries.CreateRetry(ctx, &entry); err != nil {
+		a.logError("Dead letter requeue error:", err.Error())
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	if err := a.deadLetters.DeleteDeadLetter(ctx, letter.ID); err != nil {
+		a.logError("Failed to delete requeued dead letter:", err.Error())
+	}
+	log.Printf("Requeued dead letter: ID=%s, RetryID=%s, Serial=%s, Event=%s", letter.ID, entry.ID, entry.Serial, entry.Event)
+	return c.JSON(http.StatusOK, entry)
+}
+
+func (a *App) discardDeadLetter(c echo.Context) error {
+	id := c.Param("id")
+	if err := a.deadLetters.DeleteDeadLetter(c.Request().Context(), id); err != nil {
+		return a.deadLetterError(c, err)
+	}
+	log.Printf("Discarded dead letter: ID=%s", id)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (a *App) deadLetterError(c echo.Context, err error) error {
+	if errors.Is(err, ErrRecordNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": fmt.Sprintf("dead letter %s not found", c.Param("id"))})
+	}
+	a.logError("Dead letter error:", err.Error())
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Actions a webhook event can be routed to.
+const (
+	ActionSignup        = "signup"
+	ActionUpdateAttribs = "update_attribs"
+	ActionUnsubscribe   = "unsubscribe"
+	ActionBlocklist     = "blocklist"
+	ActionTag           = "tag"
+)
+
+// EventAction performs the action of a webhook event. A returned error is transient and the
+// event is retried, permanent failures are reported through an IdempotencyFailed outcome.
+type EventAction func(ctx context.Context, ev WebhookEvent) (WebhookOutcome, error)
+
+// defaultEventRoutes maps event names to actions when the config has no events section.
+func defaultEventRoutes() map[string]string {
+	return map[string]string{
+		"signup":          ActionSignup,
+		"card_issued":     ActionSignup,
+		"profile_updated": ActionUpdateAttribs,
+		"unsubscribe":     ActionUnsubscribe,
+		"card_blocked":    ActionBlocklist,
+		"purchase":        ActionTag,
+	}
+}
+
+func (a *App) defaultEventActions() map[string]EventAction {
+	return map[string]EventAction{
+		ActionSignup:        a.signupAction,
+		ActionUpdateAttribs: a.updateAttribsAction,
+		ActionUnsubscribe:   a.unsubscribeAction,
+		ActionBlocklist:     a.blocklistAction,
+		ActionTag:           a.tagAction,
+	}
+}
+
+// eventAction resolves the action routed to event, a nil action means the event is unknown.
+func (a *App) eventAction(event string) (string, EventAction) {
+	name, ok := a.config.Events[event]
+	if !ok {
+		return "", nil
+	}
+	return name, a.eventActions[name]
+}
+
+// dispatchEvent runs the action of ev. Unknown events are acknowledged without any side effect.
+func (a *App) dispatchEvent(ctx context.Context, ev WebhookEvent) (WebhookOutcome, string, error) {
+	name, action := a.eventAction(ev.Event)
+	if action == nil {
+		log.Printf("Ignoring unknown webhook event: Serial=%s, Event=%s", ev.Serial, ev.Event)
+		return WebhookOutcome{Status: IdempotencySucceeded, Outcome: "ignored unknown event " + ev.Event}, "", nil
+	}
+	outcome, err := action(ctx, ev)
+	return outcome, name, err
+}
+
+func (a *App) signupAction(ctx context.Context, ev WebhookEvent) (WebhookOutcome, error) {
+	campaigns := a.campaignsForEvent(ev.Event, time.Now())
+	if len(campaigns) == 0 {
+		log.Printf("No active campaign for webhook event: Serial=%s, Event=%s", ev.Serial, ev.Event)
+		return WebhookOutcome{Status: IdempotencySucceeded, Outcome: "no active campaign for event " + ev.Event}, nil
+	}
+
+	mcrmData, err := a.mcrm.GetUser(ctx, cleanSerial(ev.Serial))
+	if err != nil {
+		return actionError(fmt.Errorf("MCRM API error: %w", err))
+	}
+
+	listIDs := campaignListIDs(campaigns)
+	req, err := a.mapper.Request(mcrmData, listIDs)
+	if err != nil {
+		a.logError("Subscriber mapping error:", err.Error())
+		return WebhookOutcome{Status: IdempotencyFailed, Outcome: err.Error()}, nil
+	}
+	listmonkSub, err := a.upsertListmonkSubscriber(ctx, req, listIDs)
+	if err != nil {
+		return WebhookOutcome{}, fmt.Errorf("Listmonk API error: %w", err)
+	}
+
+	subscriber, err := a.saveSubscriberEntry(ctx, listmonkSub, campaigns)
+	if err != nil {
+		a.logError("Subscriber save error:", err.Error())
+		return WebhookOutcome{Status: IdempotencyFailed, Outcome: err.Error(), SubscriberUID: listmonkSub.UID}, nil
+	}
+	return WebhookOutcome{Status: IdempotencySucceeded, Outcome: fmt.Sprintf("Subscriber UID: %d", subscriber.UID), SubscriberUID: subscriber.UID}, nil
+}
+
+// eventSubscriber resolves the MCRM user of the event and its Listmonk subscriber, which is nil
+// when the user never signed up.
+func (a *App) eventSubscriber(ctx context.Context, ev WebhookEvent) (*MCRMResponse, *ListmonkGetResponse, error) {
+	user, err := a.mcrm.GetUser(ctx, cleanSerial(ev.Serial))
+	if err != nil {
+		return nil, nil, fmt.Errorf("MCRM API error: %w", err)
+	}
+	email := user.Email
+	if req, err := a.mapper.Request(user, nil); err == nil {
+		email = req.Email
+	}
+	existing, err := a.findListmonkSubscriberByEmail(ctx, email)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Listmonk API error: %w", err)
+	}
+	return user, existing, nil
+}
+
+// actionError reports a rejected MCRM request as a failed outcome, retrying it cannot succeed.
+// Any other error is returned for a retry.
+func actionError(err error) (WebhookOutcome, error) {
+	if isPermanentMCRMError(err) {
+		return WebhookOutcome{Status: IdempotencyFailed, Outcome: err.Error()}, nil
+	}
+	return WebhookOutcome{}, err
+}
+
+func notSubscribed(ev WebhookEvent) WebhookOutcome {
+	log.Printf("Webhook event for unknown Listmonk subscriber, nothing to do: Serial=%s, Event=%s", ev.Serial, ev.Event)
+	return WebhookOutcome{Status: IdempotencySucceeded, Outcome: "subscriber not found in Listmonk"}
+}
+
+// updateAttribsAction refreshes the attribs of an existing subscriber from MCRM and the
+// optional "attribs" object of the payload.
+func (a *App) updateAttribsAction(ctx context.Context, ev WebhookEvent) (WebhookOutcome, error) {
+	user, existing, err := a.eventSubscriber(ctx, ev)
+	if err != nil {
+		return actionError(err)
+	}
+	if existing == nil {
+		return notSubscribed(ev), nil
+	}
+
+	req, err := a.mapper.Request(user, nil)
+	if err != nil {
+		a.logError("Subscriber mapping error:", err.Error())
+		return WebhookOutcome{Status: IdempotencyFailed, Outcome: err.Error()}, nil
+	}
+	if extra, ok := ev.Extra["attribs"].(map[string]interface{}); ok {
+		for key, value := range extra {
+			req.Attribs[key] = value
+		}
+	}
+	listmonkSub, err := a.mergeListmonkSubscriber(ctx, existing, req, nil)
+	if err != nil {
+		return WebhookOutcome{}, fmt.Errorf("Listmonk API error: %w", err)
+	}
+
+	subscriber, err := a.saveSubscriberEntry(ctx, listmonkSub, nil)
+	if err != nil {
+		a.logError("Subscriber save error:", err.Error())
+		return WebhookOutcome{Status: IdempotencyFailed, Outcome: err.Error(), SubscriberUID: listmonkSub.UID}, nil
+	}
+	return WebhookOutcome{Status: IdempotencySucceeded, Outcome: fmt.Sprintf("Updated attribs of subscriber UID: %d", subscriber.UID), SubscriberUID: subscriber.UID}, nil
+}
+
+// unsubscribeAction unsubscribes the subscriber from the lists of every configured campaign.
+func (a *App) unsubscribeAction(ctx context.Context, ev WebhookEvent) (WebhookOutcome, error) {
+	_, existing, err := a.eventSubscriber(ctx, ev)
+	if err != nil {
+		return actionError(err)
+	}
+	if existing == nil {
+		return notSubscribed(ev), nil
+	}
+
+	listIDs := campaignListIDs(a.config.Campaigns)
+	if err := a.listmonk.ManageSubscriberLists(ctx, ListmonkListsRequest{
+		IDs:           []int{existing.Data.ID},
+		Action:        "unsubscribe",
+		TargetListIDs: listIDs,
+	}); err != nil {
+		return WebhookOutcome{}, fmt.Errorf("Listmonk API error: %w", err)
+	}
+	log.Printf("Unsubscribed Listmonk subscriber: UID=%d, ListIDs=%v", existing.Data.ID, listIDs)
+	return WebhookOutcome{Status: IdempotencySucceeded, Outcome: fmt.Sprintf("Unsubscribed subscriber UID: %d", existing.Data.ID), SubscriberUID: existing.Data.ID}, nil
+}
+
+func (a *App) blocklistAction(ctx context.Context, ev WebhookEvent) (WebhookOutcome, error) {
+	_, existing, err := a.eventSubscriber(ctx, ev)
+	if err != nil {
+		return actionError(err)
+	}
+	if existing == nil {
+		return notSubscribed(ev), nil
+	}
+	if existing.Data.Status == "blocklisted" {
+		return WebhookOutcome{Status: IdempotencySucceeded, Outcome: "subscriber already blocklisted", SubscriberUID: existing.Data.ID}, nil
+	}
+
+	req := listmonkRequestFrom(existing)
+	req.Status = "blocklisted"
+	if _, err := a.listmonk.UpdateSubscriber(ctx, existing.Data.ID, req); err != nil {
+		return WebhookOutcome{}, fmt.Errorf("Listmonk API error: %w", err)
+	}
+	log.Printf("Blocklisted Listmonk subscriber: UID=%d", existing.Data.ID)
+	return WebhookOutcome{Status: IdempotencySucceeded, Outcome: fmt.Sprintf("Blocklisted subscriber UID: %d", existing.Data.ID), SubscriberUID: existing.Data.ID}, nil
+}
+
+// tagAction appends a tag to the "tags" attrib, taken from the payload's "tag" field or the event name.
+func (a *App) tagAction(ctx context.Context, ev WebhookEvent) (WebhookOutcome, error) {
+	_, existing, err := a.eventSubscriber(ctx, ev)
+	if err != nil {
+		return actionError(err)
+	}
+	if existing == nil {
+		return notSubscribed(ev), nil
+	}
+
+	tag, _ := ev.Extra["tag"].(string)
+	if tag == "" {
+		tag = ev.Event
+	}
+
+	req := listmonkRequestFrom(existing)
+	tags, _ := req.Attribs["tags"].([]interface{})
+	for _, t := range tags {
+		if t == tag {
+			return WebhookOutcome{Status: IdempotencySucceeded, Outcome: "subscriber already tagged " + tag, SubscriberUID: existing.Data.ID}, nil
+		}
+	}
+	req.Attribs["tags"] = append(tags, tag)
+
+	if _, err := a.listmonk.UpdateSubscriber(ctx, existing.Data.ID, req); err != nil {
+		return WebhookOutcome{}, fmt.Errorf("Listmonk API error: %w", err)
+	}
+	log.Printf("Tagged Listmonk subscriber: UID=%d, Tag=%s", existing.Data.ID, tag)
+	return WebhookOutcome{Status: IdempotencySucceeded, Outcome: fmt.Sprintf("Tagged subscriber UID: %d with %s", existing.Data.ID, tag), SubscriberUID: existing.Data.ID}, nil
+}
+
+// eventStatusCode maps an action outcome to the status code stored in the idempotency ledger.
+func eventStatusCode(outcome WebhookOutcome) int {
+	if outcome.Status == IdempotencySucceeded {
+		return http.StatusOK
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const readinessTimeout = 5 * time.Second
+
+// Pinger is implemented by the dependencies probed by /readyz.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+type DependencyStatus struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ReadinessReport struct {
+	Status string                      `json:"status"`
+	Checks map[string]DependencyStatus `json:"checks"`
+}
+
+// publicPaths are served without BasicAuth so orchestrators can probe them.
+var publicPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+func skipAuth(c echo.Context) bool {
+	return publicPaths[c.Path()]
+}
+
+func (a *App) healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (a *App) readinessChecks() map[string]func(ctx context.Context) error {
+	return map[string]func(ctx context.Context) error{
+		"config": func(ctx context.Context) error {
+			return a.config.Validate()
+		},
+		"pocketbase": a.pocketbase.Ping,
+		"listmonk": func(ctx context.Context) error {
+			_, err := a.listmonk.GetLists(ctx, 1, 1)
+			return err
+		},
+		"mcrm": a.mcrm.Ping,
+	}
+}
+
+// readyz runs every dependency check concurrently and answers 503 when any of them fails.
+func (a *App) readyz(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessTimeout)
+	defer cancel()
+
+	report := ReadinessReport{Status: "ok", Checks: make(map[string]DependencyStatus)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range a.readinessChecks() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started := time.Now()
+			err := check(ctx)
+
+			status := DependencyStatus{Status: "ok", LatencyMS: time.Since(started).Milliseconds()}
+			if err != nil {
+				status.Status = "unavailable"
+				status.Error = err.Error()
+			}
+			mu.Lock()
+			report.Checks[name] = status
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	for _, status := range report.Checks {
+		if status.Status != "ok" {
+			report.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	return c.JSON(code, report)
+}
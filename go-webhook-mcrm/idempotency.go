@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	IdempotencyProcessing = "processing"
+	IdempotencyQueued     = "queued"
+	IdempotencySucceeded  = "succeeded"
+	IdempotencyRetrying   = "retrying"
+	IdempotencyFailed     = "failed"
+)
+
+// staleProcessingAfter lets a redelivery take over a ledger entry left behind by a crashed request,
+// or a queued entry whose job was never persisted.
+const staleProcessingAfter = 10 * time.Minute
+
+type IdempotencyRecord struct {
+	ID            string `json:"id"`
+	Key           string `json:"key"`
+	RequestKey    string `json:"request_key"`
+	Serial        string `json:"serial"`
+	Event         string `json:"event"`
+	Status        string `json:"status"`
+	StatusCode    int    `json:"status_code"`
+	Outcome       string `json:"outcome"`
+	SubscriberUID int    `json:"subscriber_uid"`
+	Timestamp     string `json:"timestamp"`
+}
+
+type IdempotencyStore interface {
+	FindIdempotency(ctx context.Context, key, requestKey string) (*IdempotencyRecord, error)
+	CreateIdempotency(ctx context.Context, record *IdempotencyRecord) error
+	UpdateIdempotency(ctx context.Context, record *IdempotencyRecord) error
+}
+
+type WebhookOutcome struct {
+	Status        string `json:"status"`
+	Outcome       string `json:"outcome,omitempty"`
+	SubscriberUID int    `json:"subscriber_uid,omitempty"`
+	Duplicate     bool   `json:"duplicate,omitempty"`
+}
+
+func idempotencyKey(cleanedSerial, event string) string {
+	return cleanedSerial + ":" + event
+}
+
+// webhookIdempotencyKey identifies a delivery in the ledger. A card signs up once, so signup
+// events are deduplicated per card and event. Other events repeat, so their deliveries are told
+// apart by the Idempotency-Key header, the event timestamp or, failing both, a payload hash.
+func (a *App) webhookIdempotencyKey(ev WebhookEvent, requestKey string) string {
+	key := idempotencyKey(cleanSerial(ev.Serial), ev.Event)
+	if a.config.Events[ev.Event] == ActionSignup {
+		return key
+	}
+	switch {
+	case requestKey != "":
+		return key + ":key:" + requestKey
+	case ev.Timestamp != "":
+		return key + ":ts:" + ev.Timestamp
+	}
+	payload, _ := json.Marshal(ev)
+	sum := sha256.Sum256(payload)
+	return key + ":sha256:" + hex.EncodeToString(sum[:])
+}
+
+// ledgerKey falls back to the signup key for jobs and retries stored before keys were recorded.
+func ledgerKey(key, serial, event string) string {
+	if key != "" {
+		return key
+	}
+	return idempotencyKey(cleanSerial(serial), event)
+}
+
+func (r *IdempotencyRecord) replayable() bool {
+	switch r.Status {
+	case IdempotencySucceeded, IdempotencyRetrying:
+		return true
+	case IdempotencyQueued, IdempotencyProcessing:
+		return !r.stale()
+	}
+	return false
+}
+
+func (r *IdempotencyRecord) stale() bool {
+	started, err := time.Parse(time.RFC3339, r.Timestamp)
+	return err == nil && time.Since(started) >= staleProcessingAfter
+}
+
+// queuedJobLost reports whether a stale queued entry has no job behind it, the request that
+// queued it crashed or failed before the job was stored. A job still waiting in a long queue
+// keeps the entry, as does a failed lookup.
+func (a *App) queuedJobLost(ctx context.Context, record *IdempotencyRecord) bool {
+	if record.Status != IdempotencyQueued || a.queue == nil {
+		return true
+	}
+	exists, err := a.queue.HasJob(ctx, record.Key)
+	if err != nil {
+		a.logError("Webhook job lookup error:", err.Error())
+		return false
+	}
+	return !exists
+}
+
+func (r *IdempotencyRecord) outcome() WebhookOutcome {
+	return WebhookOutcome{
+		Status:        r.Status,
+		Outcome:       r.Outcome,
+		SubscriberUID: r.SubscriberUID,
+		Duplicate:     true,
+	}
+}
+
+// claimIdempotency returns the prior record when the delivery was already seen, otherwise it
+// stores a new processing record. A nil record with a nil prior means the ledger is unavailable
+// and the webhook is processed without deduplication.
+func (a *App) claimIdempotency(ctx context.Context, key, cleanedSerial, event, requestKey string) (record, prior *IdempotencyRecord) {
+	existing, err := a.idempotency.FindIdempotency(ctx, key, requestKey)
+	switch {
+	case err == nil && (existing.replayable() || !a.queuedJobLost(ctx, existing)):
+		return nil, existing
+	case err != nil && !errors.Is(err, ErrRecordNotFound):
+		a.logError("Idempotency lookup error:", err.Error())
+		return nil, nil
+	}
+
+	record = &IdempotencyRecord{
+		Key:        key,
+		RequestKey: requestKey,
+		Serial:     cleanedSerial,
+		Event:      event,
+		Status:     IdempotencyProcessing,
+		Timestamp:  time.Now().Format(time.RFC3339),
+	}
+	if existing != nil {
+		record.ID = existing.ID
+		if err := a.idempotency.UpdateIdempotency(ctx, record); err != nil {
+			a.logError("Idempotency update error:", err.Error())
+			return nil, nil
+		}
+		return record, nil
+	}
+
+	if err := a.idempotency.CreateIdempotency(ctx, record); err != nil {
+		// A concurrent delivery may have won the unique key, prefer its record over processing twice.
+		if existing, findErr := a.idempotency.FindIdempotency(ctx, key, requestKey); findErr == nil {
+			return nil, existing
+		}
+		a.logError("Idempotency save error:", err.Error())
+		return nil, nil
+	}
+	return record, nil
+}
+
+func (a *App) settleIdempotency(ctx context.Context, record *IdempotencyRecord, statusCode int, outcome WebhookOutcome) {
+	if record == nil {
+		return
+	}
+	record.Status = outcome.Status
+	record.StatusCode = statusCode
+	record.Outcome = outcome.Outcome
+	record.SubscriberUID = outcome.SubscriberUID
+	record.Timestamp = time.Now().Format(time.RFC3339)
+	if err := a.idempotency.UpdateIdempotency(ctx, record); err != nil {
+		a.logError("Idempotency update error:", err.Error())
+		return
+	}
+	log.Printf("Updated idempotency record: Key=%s, Status=%s", record.Key, record.Status)
+}
+
+// settleIdempotencyByKey updates the ledger entry of a webhook finished outside its request, e.g. by the queue or processRetry.
+func (a *App) settleIdempotencyByKey(ctx context.Context, key string, outcome WebhookOutcome) {
+	record, err := a.idempotency.FindIdempotency(ctx, key, "")
+	if err != nil {
+		if !errors.Is(err, ErrRecordNotFound) {
+			a.logError("Idempotency lookup error:", err.Error())
+		}
+		return
+	}
+	statusCode := http.StatusInternalServerError
+	if outcome.Status == IdempotencySucceeded {
+		statusCode = http.StatusOK
+	}
+	a.settleIdempotency(ctx, record, statusCode, outcome)
+}
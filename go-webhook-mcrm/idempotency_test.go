@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeIdempotencyStore struct {
+	record  *IdempotencyRecord
+	updates int
+}
+
+func (s *fakeIdempotencyStore) FindIdempotency(ctx context.Context, key, requestKey string) (*IdempotencyRecord, error) {
+	if s.record == nil {
+		return nil, ErrRecordNotFound
+	}
+	record := *s.record
+	return &record, nil
+}
+
+func (s *fakeIdempotencyStore) CreateIdempotency(ctx context.Context, record *IdempotencyRecord) error {
+	s.record = record
+	return nil
+}
+
+func (s *fakeIdempotencyStore) UpdateIdempotency(ctx context.Context, record *IdempotencyRecord) error {
+	s.updates++
+	s.record = record
+	return nil
+}
+
+type fakeJobStore struct {
+	JobStore
+	keys []string
+}
+
+func (s *fakeJobStore) ListJobs(ctx context.Context, opts ListOptions) (*RecordPage[WebhookJob], error) {
+	page := &RecordPage[WebhookJob]{}
+	for _, key := range s.keys {
+		if strings.Contains(opts.Filter, pbQuote(key)) {
+			page.Items = append(page.Items, WebhookJob{IdempotencyKey: key})
+		}
+	}
+	return page, nil
+}
+
+func TestClaimIdempotencyQueued(t *testing.T) {
+	const key = "123:purchase:key:abc"
+	fresh := time.Now().Format(time.RFC3339)
+	stale := time.Now().Add(-staleProcessingAfter - time.Minute).Format(time.RFC3339)
+
+	tests := []struct {
+		name      string
+		status    string
+		timestamp string
+		jobs      []string
+		wantClaim bool
+	}{
+		{name: "fresh queued record replays", status: IdempotencyQueued, timestamp: fresh},
+		{name: "stale queued record with its job replays", status: IdempotencyQueued, timestamp: stale, jobs: []string{key}},
+		{name: "stale queued record without a job is taken over", status: IdempotencyQueued, timestamp: stale, jobs: []string{"other"}, wantClaim: true},
+		{name: "fresh processing record replays", status: IdempotencyProcessing, timestamp: fresh},
+		{name: "stale processing record is taken over", status: IdempotencyProcessing, timestamp: stale, wantClaim: true},
+		{name: "succeeded record replays", status: IdempotencySucceeded, timestamp: stale},
+		{name: "failed record is taken over", status: IdempotencyFailed, timestamp: fresh, wantClaim: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeIdempotencyStore{record: &IdempotencyRecord{ID: "rec1", Key: key, Status: tt.status, Timestamp: tt.timestamp}}
+			a := &App{
+				idempotency: store,
+				queue:       NewJobQueue(&fakeJobStore{keys: tt.jobs}, 1, 1, nil),
+				logs:        fakeLogStore{},
+			}
+
+			record, prior := a.claimIdempotency(context.Background(), key, "123", "purchase", "abc")
+			if tt.wantClaim {
+				if record == nil || prior != nil || store.record.Status != IdempotencyProcessing {
+					t.Fatalf("claim = %v, prior %v, want a new processing record", record, prior)
+				}
+				return
+			}
+			if record != nil || prior == nil || prior.Status != tt.status || store.updates != 0 {
+				t.Fatalf("claim = %v, prior %v, want the %s record replayed", record, prior, tt.status)
+			}
+		})
+	}
+}
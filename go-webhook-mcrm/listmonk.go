@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ListmonkCreateResponse struct {
+	Data struct {
+		ID      int                    `json:"id"`
+		Email   string                 `json:"email"`
+		Attribs map[string]interface{} `json:"attribs"`
+		Phone   string                 `json:"phone"`
+		Status  string                 `json:"status"`
+		Lists   []ListmonkSubscription `json:"lists"`
+	} `json:"data"`
+}
+
+// ListmonkSubscription is a list as embedded in a subscriber, with the subscription to it.
+type ListmonkSubscription struct {
+	ID                    int                    `json:"id"`
+	UUID                  string                 `json:"uuid"`
+	Name                  string                 `json:"name"`
+	Type                  string                 `json:"type"`
+	Optin                 string                 `json:"optin"`
+	Tags                  []string               `json:"tags"`
+	Description           string                 `json:"description"`
+	CreatedAt             string                 `json:"created_at"`
+	UpdatedAt             string                 `json:"updated_at"`
+	SubscriptionStatus    string                 `json:"subscription_status"`
+	SubscriptionCreatedAt string                 `json:"subscription_created_at"`
+	SubscriptionUpdatedAt string                 `json:"subscription_updated_at"`
+	SubscriptionMeta      map[string]interface{} `json:"subscription_meta"`
+}
+
+type ListmonkGetResponse struct {
+	Data struct {
+		ID        int                    `json:"id"`
+		CreatedAt string                 `json:"created_at"`
+		UpdatedAt string                 `json:"updated_at"`
+		UUID      string                 `json:"uuid"`
+		Email     string                 `json:"email"`
+		Name      string                 `json:"name"`
+		Attribs   map[string]interface{} `json:"attribs"`
+		Status    string                 `json:"status"`
+		Lists     []ListmonkSubscription `json:"lists"`
+	} `json:"data"`
+}
+
+type ListmonkSubscriberListResponse struct {
+	Data struct {
+		Results []struct {
+			ID        int                    `json:"id"`
+			CreatedAt string                 `json:"created_at"`
+			UpdatedAt string                 `json:"updated_at"`
+			Email     string                 `json:"email"`
+			Name      string                 `json:"name"`
+			Attribs   map[string]interface{} `json:"attribs"`
+			Phone     string                 `json:"phone"`
+			Status    string                 `json:"status"`
+			Lists     []ListmonkSubscription `json:"lists"`
+		} `json:"results"`
+		Total   int `json:"total"`
+		PerPage int `json:"per_page"`
+		Page    int `json:"page"`
+	} `json:"data"`
+}
+
+type ListmonkSubscriberRequest struct {
+	Email                   string                 `json:"email"`
+	Name                    string                 `json:"name"`
+	Status                  string                 `json:"status"`
+	Lists                   []int                  `json:"lists"`
+	Attribs                 map[string]interface{} `json:"attribs"`
+	PreconfirmSubscriptions bool                   `json:"preconfirm_subscriptions,omitempty"`
+}
+
+type ListmonkSubscriberQuery struct {
+	ListID  int
+	Query   string
+	OrderBy string
+	Order   string
+	Page    int
+	PerPage int
+}
+
+// ListmonkListsRequest mirrors PUT /api/subscribers/lists, Action is add, remove or unsubscribe.
+type ListmonkListsRequest struct {
+	IDs           []int  `json:"ids"`
+	Action        string `json:"action"`
+	TargetListIDs []int  `json:"target_list_ids"`
+	Status        string `json:"status,omitempty"`
+}
+
+type ListmonkList struct {
+	ID              int      `json:"id"`
+	UUID            string   `json:"uuid"`
+	Name            string   `json:"name"`
+	Type            string   `json:"type"`
+	Optin           string   `json:"optin"`
+	Tags            []string `json:"tags"`
+	Description     string   `json:"description"`
+	SubscriberCount int      `json:"subscriber_count"`
+	CreatedAt       string   `json:"created_at"`
+	UpdatedAt       string   `json:"updated_at"`
+}
+
+type ListmonkListRequest struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Optin       string   `json:"optin"`
+	Tags        []string `json:"tags"`
+	Description string   `json:"description"`
+}
+
+type ListmonkListResponse struct {
+	Data ListmonkList `json:"data"`
+}
+
+type ListmonkListsResponse struct {
+	Data struct {
+		Results []ListmonkList `json:"results"`
+		Total   int            `json:"total"`
+		PerPage int            `json:"per_page"`
+		Page    int            `json:"page"`
+	} `json:"data"`
+}
+
+// ListmonkAPI is the subset of the Listmonk API used by the sync pipeline.
+type ListmonkAPI interface {
+	CreateSubscriber(ctx context.Context, req ListmonkSubscriberRequest) (*ListmonkCreateResponse, error)
+	GetSubscriber(ctx context.Context, id int) (*ListmonkGetResponse, error)
+	ListSubscribers(ctx context.Context, query ListmonkSubscriberQuery) (*ListmonkSubscriberListResponse, error)
+	UpdateSubscriber(ctx context.Context, id int, req ListmonkSubscriberRequest) (*ListmonkGetResponse, error)
+	DeleteSubscriber(ctx context.Context, id int) error
+	ManageSubscriberLists(ctx context.Context, req ListmonkListsRequest) error
+	SubscriptionStatus(ctx context.Context, subscriberID, listID int) (string, error)
+	SubscriberBounces(ctx context.Context, subscriberID int) (int, error)
+
+	GetLists(ctx context.Context, page, perPage int) (*ListmonkListsResponse, error)
+	GetList(ctx context.Context, id int) (*ListmonkListResponse, error)
+	CreateList(ctx context.Context, req ListmonkListRequest) (*ListmonkListResponse, error)
+	UpdateList(ctx context.Context, id int, req ListmonkListRequest) (*ListmonkListResponse, error)
+	DeleteList(ctx context.Context, id int) error
+}
+
+type ListmonkError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *ListmonkError) Error() string {
+	return fmt.Sprintf("Listmonk API error: %s %s, Status: %d, Response: %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+// IsListmonkStatus reports whether err is a Listmonk API error with the given status code.
+func IsListmonkStatus(err error, statusCode int) bool {
+	var lmErr *ListmonkError
+	return errors.As(err, &lmErr) && lmErr.StatusCode == statusCode
+}
+
+type ListmonkClient struct {
+	baseURL string
+	auth    string
+	client  *http.Client
+}
+
+// NewListmonkClient accepts LISTMONK_API_URL either as the API root or as its /subscribers endpoint.
+func NewListmonkClient(apiURL, username, apiKey string) *ListmonkClient {
+	baseURL := strings.TrimSuffix(apiURL, "/")
+	baseURL = strings.TrimSuffix(baseURL, "/subscribers")
+	return &ListmonkClient{
+		baseURL: baseURL,
+		auth:    "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+apiKey)),
+		client:  &http.Client{Timeout: 30 * time.Second, Transport: instrumentTransport("listmonk")},
+	}
+}
+
+func (l *ListmonkClient) CreateSubscriber(ctx context.Context, req ListmonkSubscriberRequest) (*ListmonkCreateResponse, error) {
+	var resp ListmonkCreateResponse
+	if err := l.do(ctx, http.MethodPost, "/subscribers", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (l *ListmonkClient) GetSubscriber(ctx context.Context, id int) (*ListmonkGetResponse, error) {
+	var resp ListmonkGetResponse
+	if err := l.do(ctx, http.MethodGet, fmt.Sprintf("/subscribers/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (l *ListmonkClient) ListSubscribers(ctx context.Context, query ListmonkSubscriberQuery) (*ListmonkSubscriberListResponse, error) {
+	params := url.Values{}
+	if query.ListID > 0 {
+		params.Set("list_id", strconv.Itoa(query.ListID))
+	}
+	if query.Query != "" {
+		params.Set("query", query.Query)
+	}
+	if query.OrderBy != "" {
+		params.Set("order_by", query.OrderBy)
+	}
+	if query.Order != "" {
+		params.Set("order", query.Order)
+	}
+	if query.Page > 0 {
+		params.Set("page", strconv.Itoa(query.Page))
+	}
+	if query.PerPage > 0 {
+		params.Set("per_page", strconv.Itoa(query.PerPage))
+	}
+
+	var resp ListmonkSubscriberListResponse
+	if err := l.do(ctx, http.MethodGet, "/subscribers?"+params.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (l *ListmonkClient) UpdateSubscriber(ctx context.Context, id int, req ListmonkSubscriberRequest) (*ListmonkGetResponse, error) {
+	var resp ListmonkGetResponse
+	if err := l.do(ctx, http.MethodPut, fmt.Sprintf("/subscribers/%d", id), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (l *ListmonkClient) DeleteSubscriber(ctx context.Context, id int) error {
+	return l.do(ctx, http.MethodDelete, fmt.Sprintf("/subscribers/%d", id), nil, nil)
+}
+
+func (l *ListmonkClient) ManageSubscriberLists(ctx context.Context, req ListmonkListsRequest) error {
+	return l.do(ctx, http.MethodPut, "/subscribers/lists", req, nil)
+}
+
+// SubscriptionStatus returns the subscriber's status on the list, or "" when it is not subscribed at all.
+func (l *ListmonkClient) SubscriptionStatus(ctx context.Context, subscriberID, listID int) (string, error) {
+	sub, err := l.GetSubscriber(ctx, subscriberID)
+	if err != nil {
+		return "", err
+	}
+	for _, list := range sub.Data.Lists {
+		if list.ID == listID {
+			return list.SubscriptionStatus, nil
+		}
+	}
+	return "", nil
+}
+
+// SubscriberBounces counts the bounces Listmonk recorded for the subscriber.
+func (l *ListmonkClient) SubscriberBounces(ctx context.Context, subscriberID int) (int, error) {
+	var resp struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	if err := l.do(ctx, http.MethodGet, fmt.Sprintf("/subscribers/%d/bounces", subscriberID), nil, &resp); err != nil {
+		return 0, err
+	}
+	return len(resp.Data), nil
+}
+
+func (l *ListmonkClient) GetLists(ctx context.Context, page, perPage int) (*ListmonkListsResponse, error) {
+	var resp ListmonkListsResponse
+	if err := l.do(ctx, http.MethodGet, fmt.Sprintf("/lists?page=%d&per_page=%d", page, perPage), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (l *ListmonkClient) GetList(ctx context.Context, id int) (*ListmonkListResponse, error) {
+	var resp ListmonkListResponse
+	if err := l.do(ctx, http.MethodGet, fmt.Sprintf("/lists/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (l *ListmonkClient) CreateList(ctx context.Context, req ListmonkListRequest) (*ListmonkListResponse, error) {
+	var resp ListmonkListResponse
+	if err := l.do(ctx, http.MethodPost, "/lists", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (l *ListmonkClient) UpdateList(ctx context.Context, id int, req ListmonkListRequest) (*ListmonkListResponse, error) {
+	var resp ListmonkListResponse
+	if err := l.do(ctx, http.MethodPut, fmt.Sprintf("/lists/%d", id), req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (l *ListmonkClient) DeleteList(ctx context.Context, id int) error {
+	return l.do(ctx, http.MethodDelete, fmt.Sprintf("/lists/%d", id), nil, nil)
+}
+
+func (l *ListmonkClient) do(ctx context.Context, method, path string, payload, out interface{}) error {
+	reqURL := l.baseURL + path
+
+	var body io.Reader
+	if payload != nil {
+		jsonPayload, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(jsonPayload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return fmt.Errorf("Listmonk request error: %v", err)
+	}
+	req.Header.Set("Authorization", l.auth)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Listmonk API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read Listmonk response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return &ListmonkError{Method: method, URL: reqURL, StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("Listmonk decode error: Error: %v, Response: %s", err, string(respBody))
+	}
+	return nil
+}
@@ -2,85 +2,44 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/schollz/progressbar/v3"
-	"golang.org/x/net/context"
 )
 
+// MCRMResponse keeps the full user JSON in Raw for the Listmonk field mapping.
 type MCRMResponse struct {
-	FirstName  string `json:"first_name"`
-	LastName   string `json:"last_name"`
-	Phone      string `json:"phone"`
-	CardNumber string `json:"card_number"`
-	Email      string `json:"email"`
+	FirstName  string                 `json:"first_name"`
+	LastName   string                 `json:"last_name"`
+	Phone      string                 `json:"phone"`
+	CardNumber string                 `json:"card_number"`
+	Email      string                 `json:"email"`
+	Raw        map[string]interface{} `json:"-"`
 }
 
-type ListmonkCreateResponse struct {
-	Data struct {
-		ID      int                    `json:"id"`
-		Email   string                 `json:"email"`
-		Attribs map[string]interface{} `json:"attribs"`
-		Phone   string                 `json:"phone"`
-		Status  string                 `json:"status"`
-		Lists   []struct {
-			ID int `json:"id"`
-		} `json:"lists"`
-	} `json:"data"`
-}
-
-type ListmonkGetResponse struct {
-	Data struct {
-		ID        int                    `json:"id"`
-		CreatedAt string                 `json:"created_at"`
-		UpdatedAt string                 `json:"updated_at"`
-		UUID      string                 `json:"uuid"`
-		Email     string                 `json:"email"`
-		Name      string                 `json:"name"`
-		Attribs   map[string]interface{} `json:"attribs"`
-		Status    string                 `json:"status"`
-		Lists     []struct {
-			SubscriptionStatus    string                 `json:"subscription_status"`
-			SubscriptionCreatedAt string                 `json:"subscription_created_at"`
-			SubscriptionUpdatedAt string                 `json:"subscription_updated_at"`
-			SubscriptionMeta      map[string]interface{} `json:"subscription_meta"`
-			ID                    int                    `json:"id"`
-			UUID                  string                 `json:"uuid"`
-			Name                  string                 `json:"name"`
-			Type                  string                 `json:"type"`
-			Optin                 string                 `json:"optin"`
-			Tags                  []string               `json:"tags"`
-			Description           string                 `json:"description"`
-			CreatedAt             string                 `json:"created_at"`
-			UpdatedAt             string                 `json:"updated_at"`
-		} `json:"lists"`
-	} `json:"data"`
-}
-
-type ListmonkSubscriberListResponse struct {
-	Data []struct {
-		ID      int                    `json:"id"`
-		Email   string                 `json:"email"`
-		Attribs map[string]interface{} `json:"attribs"`
-		Phone   string                 `json:"phone"`
-		Status  string                 `json:"status"`
-		Lists   []struct {
-			ID int `json:"id"`
-		} `json:"lists"`
-	} `json:"data"`
+// fields is the mapping input for a response built without Raw.
+func (r *MCRMResponse) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"first_name":  r.FirstName,
+		"last_name":   r.LastName,
+		"phone":       r.Phone,
+		"card_number": r.CardNumber,
+		"email":       r.Email,
+	}
 }
 
 type LogEntry struct {
@@ -90,20 +49,55 @@ type LogEntry struct {
 }
 
 type RetryEntry struct {
-	ID           string `json:"id"`
-	Serial       string `json:"serial"`
-	Event        string `json:"event"`
-	RetryCount   int    `json:"retry_count"`
-	ErrorMessage string `json:"error_message"`
-	Timestamp    string `json:"timestamp"`
+	ID             string                 `json:"id"`
+	Serial         string                 `json:"serial"`
+	Event          string                 `json:"event"`
+	RetryCount     int                    `json:"retry_count"`
+	ErrorMessage   string                 `json:"error_message"`
+	LastError      string                 `json:"last_error"`
+	NextAttemptAt  string                 `json:"next_attempt_at"`
+	SubscriberUID  int                    `json:"subscriber_uid"`
+	CampaignID     string                 `json:"campaign_id"`
+	IdempotencyKey string                 `json:"idempotency_key"`
+	Extra          map[string]interface{} `json:"extra"`
+	Attempts       []RetryAttempt         `json:"attempts"`
+	Timestamp      string                 `json:"timestamp"`
 }
 
+type RetryAttempt struct {
+	At    string `json:"at"`
+	Error string `json:"error"`
+}
+
+// SubscriberEntry tracks bonuses per campaign in Bonuses (campaign ID to state). BonusStatus
+// is true once no campaign is pending anymore. Status and Lists mirror the Listmonk subscriber
+// status and the subscription status per list ID as of LastCheckedAt, Confirmed the date Listmonk
+// recorded each list's subscription as confirmed.
 type SubscriberEntry struct {
-	ID          string `json:"id"`
-	UID         int    `json:"uid"`
-	Email       string `json:"email"`
-	Phone       string `json:"phone"`
-	BonusStatus bool   `json:"bonus_status"`
+	ID            string            `json:"id"`
+	UID           int               `json:"uid"`
+	Email         string            `json:"email"`
+	Phone         string            `json:"phone"`
+	BonusStatus   bool              `json:"bonus_status"`
+	Bonuses       map[string]string `json:"bonuses"`
+	Status        string            `json:"status"`
+	Lists         map[int]string    `json:"lists"`
+	Bounces       int               `json:"bounces"`
+	Confirmed     map[int]string    `json:"confirmed"`
+	LastCheckedAt string            `json:"last_checked_at"`
+}
+
+// sleepCtx waits for d unless ctx is cancelled first, reporting whether the full duration elapsed.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
 }
 
 func cleanSerial(serial string) string {
@@ -113,244 +107,146 @@ func cleanSerial(serial string) string {
 	return serial
 }
 
-func logToPocketBase(pbURL, collection string, data interface{}, updateID string) (string, error) {
-	if pbURL == "" {
-		return "", fmt.Errorf("POCKETBASE_URL is not set")
-	}
-
-	var url string
-	var method string
-	if updateID == "" {
-		url = fmt.Sprintf("%s/api/collections/%s/records", pbURL, collection)
-		method = http.MethodPost
-	} else {
-		url = fmt.Sprintf("%s/api/collections/%s/records/%s", pbURL, collection, updateID)
-		method = http.MethodPatch
-	}
-
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return "", err
-	}
-
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("POCKETBASE_ADMIN_TOKEN"))
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("API error: %d, %s", resp.StatusCode, string(body))
-	}
-
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("failed to decode response: %v", err)
-	}
-	if id, ok := result["id"].(string); ok {
-		return id, nil
-	}
-	if updateID != "" {
-		return updateID, nil
+func attribString(attribs map[string]interface{}, key string) string {
+	if value, ok := attribs[key]; ok {
+		if str, ok := value.(string); ok {
+			return str
+		}
 	}
-	return "", fmt.Errorf("no ID returned from PocketBase, response: %v", result)
+	return ""
 }
 
-func updateRetryEntry(pbURL string, entry RetryEntry) error {
-	url := fmt.Sprintf("%s/api/collections/retry/records/%s", pbURL, entry.ID)
-	jsonData, err := json.Marshal(entry)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("POCKETBASE_ADMIN_TOKEN"))
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("API error: %d, %s", resp.StatusCode, string(body))
-	}
-
-	log.Printf("Updated retry entry in PocketBase: ID=%s, Serial=%s, RetryCount=%d", entry.ID, entry.Serial, entry.RetryCount)
-	return nil
+type App struct {
+	config      *Config
+	pocketbase  Pinger
+	mcrm        MCRMAPI
+	listmonk    ListmonkAPI
+	subscribers SubscriberStore
+	retries     RetryStore
+	logs        LogStore
+	idempotency IdempotencyStore
+	deadLetters DeadLetterStore
+	bonuses     BonusLedgerStore
+	syncState   SyncStateStore
+	queue       *JobQueue
+	backoff     BackoffPolicy
+
+	retryHandlers map[string]RetryHandler
+	eventActions  map[string]EventAction
+	mapper        *SubscriberMapper
+
+	scheduler    *Scheduler
+	syncInterval time.Duration
+	lastSync     time.Time
 }
 
-func processWebhook(c echo.Context) error {
+func (a *App) processWebhook(c echo.Context) error {
 	bodyBytes, err := io.ReadAll(c.Request().Body)
 	if err != nil {
-		logError("Failed to read webhook body:", err.Error())
+		a.logError("Failed to read webhook body:", err.Error())
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	c.Request().Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
-	serial := c.FormValue("serial")
-	event := c.FormValue("event")
-	cleanedSerial := cleanSerial(serial)
-
-	if serial == "" || event == "" {
-		logError("Missing serial or event in webhook", fmt.Sprintf("Body: %s", string(bodyBytes)))
-		return c.NoContent(http.StatusBadRequest)
+	if err := a.verifySignature(c.Request().Header, bodyBytes, time.Now()); err != nil {
+		a.logError("Webhook signature rejected:", err.Error())
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
 	}
 
-	mcrmURL := os.Getenv("MCRM_API_URL_USER")
-	apiKey := os.Getenv("MCRM_API_KEY")
-	if apiKey == "" {
-		logError("MCRM API key is not set", "Please set MCRM_API_KEY environment variable")
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	req, err := http.NewRequest("POST", mcrmURL, bytes.NewBufferString(fmt.Sprintf(`{"number":"%s"}`, cleanedSerial)))
-	if err != nil {
-		logError("MCRM request error:", err.Error())
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	req.Header.Set("x-api-key", apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	payload, err := parseWebhookEvent(c, bodyBytes)
 	if err != nil {
-		logError("MCRM API error:", err.Error())
-		addToRetry(os.Getenv("POCKETBASE_URL"), serial, event, err.Error())
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer resp.Body.Close()
-
-	mcrmBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		logError("Failed to read MCRM response body:", err.Error())
-		addToRetry(os.Getenv("POCKETBASE_URL"), serial, event, err.Error())
-		return c.NoContent(http.StatusInternalServerError)
+		webhooksReceived.WithLabelValues("invalid").Inc()
+		a.logError("Invalid webhook payload:", fmt.Sprintf("%v, Body: %s", err, string(bodyBytes)))
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{"error": "invalid webhook payload", "fields": validationErr.Fields})
+		}
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 	}
-	resp.Body.Close()
-	resp.Body = io.NopCloser(bytes.NewBuffer(mcrmBody))
 
-	if resp.StatusCode != http.StatusOK {
-		logError("MCRM API error:", fmt.Sprintf("Status: %d, Response: %s", resp.StatusCode, string(mcrmBody)))
-		addToRetry(os.Getenv("POCKETBASE_URL"), serial, event, fmt.Sprintf("Status: %d, Response: %s", resp.StatusCode, string(mcrmBody)))
-		return c.NoContent(http.StatusInternalServerError)
-	}
+	serial := payload.Serial
+	event := payload.Event
+	webhooksReceived.WithLabelValues(a.eventLabel(event)).Inc()
+	cleanedSerial := cleanSerial(serial)
 
-	var mcrmData MCRMResponse
-	if err := json.NewDecoder(io.NopCloser(bytes.NewBuffer(mcrmBody))).Decode(&mcrmData); err != nil {
-		logError("MCRM decode error:", fmt.Sprintf("Error: %v, Response: %s", err, string(mcrmBody)))
-		addToRetry(os.Getenv("POCKETBASE_URL"), serial, event, fmt.Sprintf("Error: %v, Response: %s", err, string(mcrmBody)))
-		return c.NoContent(http.StatusInternalServerError)
-	}
+	ctx := c.Request().Context()
+
+	requestKey := c.Request().Header.Get("Idempotency-Key")
+	key := a.webhookIdempotencyKey(*payload, requestKey)
+	record, prior := a.claimIdempotency(ctx, key, cleanedSerial, event, requestKey)
+	if prior != nil {
+		log.Printf("Duplicate webhook: Serial=%s, Event=%s, Status=%s", serial, event, prior.Status)
+		webhooksProcessed.WithLabelValues(a.eventLabel(event), "duplicate").Inc()
+		return c.JSON(http.StatusOK, prior.outcome())
+	}
+
+	job := WebhookJob{
+		Serial:         serial,
+		Event:          event,
+		EventTimestamp: payload.Timestamp,
+		Extra:          payload.Extra,
+		RequestKey:     requestKey,
+		IdempotencyKey: key,
+	}
+	// The ledger is marked queued before the job exists: once enqueued, a worker may settle the
+	// record at any time and this request must not overwrite it.
+	outcome := WebhookOutcome{Status: IdempotencyQueued}
+	a.settleIdempotency(ctx, record, http.StatusAccepted, outcome)
+	if err := a.queue.Enqueue(ctx, job); err != nil {
+		a.logError("Webhook enqueue error:", err.Error())
+		a.settleIdempotency(ctx, record, http.StatusServiceUnavailable, WebhookOutcome{Status: IdempotencyFailed, Outcome: err.Error()})
+		return c.NoContent(http.StatusServiceUnavailable)
+	}
+	return c.JSON(http.StatusAccepted, outcome)
+}
 
-	listmonkURL := os.Getenv("LISTMONK_API_URL")
-	listID, err := strconv.Atoi(os.Getenv("LIST_ID"))
-	if err != nil {
-		logError("Invalid LIST_ID:", err.Error())
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	listmonkPayload := map[string]interface{}{
-		"email":  mcrmData.Email,
-		"name":   fmt.Sprintf("%s %s", mcrmData.FirstName, mcrmData.LastName),
-		"status": "enabled",
-		"lists":  []int{listID},
-		"attribs": map[string]interface{}{
-			"phone":       mcrmData.Phone,
-			"card_number": mcrmData.CardNumber,
-		},
+func (a *App) runWebhookJob(ctx context.Context, job WebhookJob) {
+	key := ledgerKey(job.IdempotencyKey, job.Serial, job.Event)
+	outcome, statusCode := a.handleWebhook(ctx, WebhookEvent{Serial: job.Serial, Event: job.Event, Timestamp: job.EventTimestamp, Extra: job.Extra}, key)
+	if ctx.Err() != nil {
+		// Cancelled at shutdown: the persisted job stays the only owner and runs again on start.
+		return
 	}
-	jsonPayload, _ := json.Marshal(listmonkPayload)
+	webhooksProcessed.WithLabelValues(a.eventLabel(job.Event), outcome.Status).Inc()
+	a.settleIdempotencyByKey(ctx, key, outcome)
 
-	req, err = http.NewRequest("POST", listmonkURL, bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		logError("Listmonk request error:", err.Error())
-		return c.NoContent(http.StatusInternalServerError)
+	if statusCode == http.StatusOK {
+		a.scheduler.Nudge()
 	}
-	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(os.Getenv("LISTMONK_USERNAME")+":"+os.Getenv("LISTMONK_API_KEY"))))
-	req.Header.Set("Content-Type", "application/json")
+}
 
-	resp, err = client.Do(req)
-	if err != nil {
-		logError("Listmonk API error:", err.Error())
-		addToRetry(os.Getenv("POCKETBASE_URL"), serial, event, err.Error())
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer resp.Body.Close()
+func (a *App) queueStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, a.queue.Stats(c.Request().Context()))
+}
 
-	listmonkBody, err := io.ReadAll(resp.Body)
+func (a *App) handleWebhook(ctx context.Context, ev WebhookEvent, key string) (WebhookOutcome, int) {
+	outcome, action, err := a.dispatchEvent(ctx, ev)
 	if err != nil {
-		logError("Failed to read Listmonk response body:", err.Error())
-		addToRetry(os.Getenv("POCKETBASE_URL"), serial, event, err.Error())
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	resp.Body.Close()
-	resp.Body = io.NopCloser(bytes.NewBuffer(listmonkBody))
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		logError("Listmonk API error:", fmt.Sprintf("Status: %d, Response: %s", resp.StatusCode, string(listmonkBody)))
-		addToRetry(os.Getenv("POCKETBASE_URL"), serial, event, string(listmonkBody))
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	var listmonkResp ListmonkCreateResponse
-	if err := json.NewDecoder(io.NopCloser(bytes.NewBuffer(listmonkBody))).Decode(&listmonkResp); err != nil {
-		logError("Listmonk decode error:", fmt.Sprintf("Error: %v, Response: %s", err, string(listmonkBody)))
-		addToRetry(os.Getenv("POCKETBASE_URL"), serial, event, fmt.Sprintf("Error: %v, Response: %s", err, string(listmonkBody)))
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	phone := ""
-	if attribs, ok := listmonkResp.Data.Attribs["phone"]; ok {
-		if phoneStr, ok := attribs.(string); ok {
-			phone = phoneStr
+		a.logError("Webhook "+action+" error:", err.Error())
+		if ctx.Err() == nil {
+			a.addToRetry(ev, key, err.Error())
 		}
+		return WebhookOutcome{Status: IdempotencyRetrying, Outcome: err.Error()}, http.StatusInternalServerError
 	}
-	subscriber := SubscriberEntry{
-		UID:         listmonkResp.Data.ID,
-		Email:       listmonkResp.Data.Email,
-		Phone:       phone,
-		BonusStatus: false,
+	if outcome.Status != IdempotencySucceeded {
+		return outcome, eventStatusCode(outcome)
 	}
-	id, err := logToPocketBase(os.Getenv("POCKETBASE_URL"), "subscribers", subscriber, "")
-	if err != nil {
-		logError("Subscriber save error:", err.Error())
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	subscriber.ID = id
-	log.Printf("Saved subscriber to PocketBase: UID=%d, Email=%s, Phone=%s", subscriber.UID, subscriber.Email, subscriber.Phone)
 
 	logEntry := LogEntry{
 		ErrorMessage: "Webhook processed successfully",
 		Timestamp:    time.Now().Format(time.RFC3339),
-		Response:     fmt.Sprintf("Subscriber UID: %d", listmonkResp.Data.ID),
+		Response:     outcome.Outcome,
 	}
-	if _, err := logToPocketBase(os.Getenv("POCKETBASE_URL"), "logs", logEntry, ""); err != nil {
-		logError("Log save error:", err.Error())
+	if err := a.logs.CreateLog(ctx, logEntry); err != nil {
+		a.logError("Log save error:", err.Error())
 	} else {
-		log.Printf("Logged webhook success: Subscriber UID=%d", listmonkResp.Data.ID)
+		log.Printf("Logged webhook success: Event=%s, Subscriber UID=%d", ev.Event, outcome.SubscriberUID)
 	}
 
-	go checkSubscriptions(os.Getenv("POCKETBASE_URL"), os.Getenv("MCRM_API_KEY"))
-
-	return c.NoContent(http.StatusOK)
+	return outcome, http.StatusOK
 }
 
-func logError(message, details string, uid ...int) {
+func (a *App) logError(message, details string, uid ...int) {
 	var uidStr string
 	if len(uid) > 0 {
 		uidStr = fmt.Sprintf(" UID: %d", uid[0])
@@ -360,563 +256,204 @@ func logError(message, details string, uid ...int) {
 		Timestamp:    time.Now().Format(time.RFC3339),
 		Response:     details,
 	}
-	if _, err := logToPocketBase(os.Getenv("POCKETBASE_URL"), "logs", logEntry, ""); err != nil {
+	if err := a.logs.CreateLog(context.Background(), logEntry); err != nil {
 		log.Printf("Failed to log error to PocketBase: %v", err)
 	} else {
 		log.Printf("Logged error to PocketBase: %s%s, Details: %s", message, uidStr, details)
 	}
 }
 
-func addToRetry(pbURL, serial, event, errorMessage string) error {
-	retryEntry := RetryEntry{
-		Serial:       serial,
-		Event:        event,
-		RetryCount:   0,
-		ErrorMessage: errorMessage,
-		Timestamp:    time.Now().Format(time.RFC3339),
-	}
-	id, err := logToPocketBase(pbURL, "retry", retryEntry, "")
-	if err != nil {
-		logError("Retry save error:", err.Error())
-		return err
-	}
-	retryEntry.ID = id
-	log.Printf("Added retry entry to PocketBase: Serial=%s, Event=%s, ID=%s", serial, event, id)
-	return nil
-}
-
-func processRetry(pbURL, apiKey string) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	maxRetries := 5
-
-	for {
-		resp, err := client.Get(fmt.Sprintf("%s/api/collections/retry/records", pbURL))
-		if err != nil {
-			logError("Failed to fetch retry entries:", err.Error())
-			time.Sleep(30 * time.Second)
-			continue
-		}
-		defer resp.Body.Close()
-
-		var retryData struct {
-			Items []RetryEntry `json:"items"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&retryData); err != nil {
-			logError("Failed to decode retry entries:", err.Error())
-			time.Sleep(30 * time.Second)
-			continue
-		}
-
-		for _, entry := range retryData.Items {
-			if entry.RetryCount >= maxRetries {
-				logError("Max retries reached for serial:", entry.Serial)
-				if err := deleteRetryEntry(pbURL, entry.ID); err != nil {
-					logError("Failed to delete retry entry:", err.Error())
-				} else {
-					log.Printf("Deleted retry entry from PocketBase: ID=%s, Serial=%s", entry.ID, entry.Serial)
-				}
-				continue
-			}
-
-			req, err := http.NewRequest("POST", os.Getenv("MCRM_API_URL_USER"), bytes.NewBufferString(fmt.Sprintf(`{"number":"%s"}`, entry.Serial)))
-			if err != nil {
-				logError("Retry request error:", err.Error())
-				continue
-			}
-			req.Header.Set("x-api-key", apiKey)
-			req.Header.Set("Content-Type", "application/json")
-
-			resp, err := client.Do(req)
-			if err != nil || resp.StatusCode != http.StatusOK {
-				body, _ := io.ReadAll(resp.Body)
-				entry.RetryCount++
-				logError("Retry failed for serial:", fmt.Sprintf("Serial: %s, Attempt: %d, Status: %d, Body: %s", entry.Serial, entry.RetryCount, resp.StatusCode, string(body)))
-				if err := updateRetryEntry(pbURL, entry); err != nil {
-					logError("Failed to update retry entry:", err.Error())
-				}
-				time.Sleep(1 * time.Minute)
-				continue
-			}
-
-			body, _ := io.ReadAll(resp.Body)
-			var mcrmData MCRMResponse
-			if err := json.NewDecoder(bytes.NewReader(body)).Decode(&mcrmData); err != nil {
-				logError("MCRM decode error:", fmt.Sprintf("Error: %v, Response: %s", err, string(body)))
-				entry.RetryCount++
-				if err := updateRetryEntry(pbURL, entry); err != nil {
-					logError("Failed to update retry entry:", err.Error())
-				}
-				continue
-			}
-
-			listmonkURL := os.Getenv("LISTMONK_API_URL")
-			listID, err := strconv.Atoi(os.Getenv("LIST_ID"))
-			if err != nil {
-				logError("Invalid LIST_ID:", err.Error())
-				continue
-			}
-			listmonkPayload := map[string]interface{}{
-				"email":  mcrmData.Email,
-				"name":   fmt.Sprintf("%s %s", mcrmData.FirstName, mcrmData.LastName),
-				"status": "enabled",
-				"lists":  []int{listID},
-				"attribs": map[string]interface{}{
-					"phone":       mcrmData.Phone,
-					"card_number": mcrmData.CardNumber,
-				},
-			}
-			jsonPayload, _ := json.Marshal(listmonkPayload)
-
-			req, err = http.NewRequest("POST", listmonkURL, bytes.NewBuffer(jsonPayload))
-			if err != nil {
-				logError("Listmonk request error:", err.Error())
-				continue
-			}
-			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(os.Getenv("LISTMONK_USERNAME")+":"+os.Getenv("LISTMONK_API_KEY"))))
-			req.Header.Set("Content-Type", "application/json")
-
-			listmonkResp, err := client.Do(req)
-			if err != nil || (listmonkResp.StatusCode != http.StatusOK && listmonkResp.StatusCode != http.StatusCreated) {
-				listmonkBody, _ := io.ReadAll(listmonkResp.Body)
-				logError("Listmonk API error:", fmt.Sprintf("Status: %d, Response: %s", listmonkResp.StatusCode, string(listmonkBody)))
-				entry.RetryCount++
-				if err := updateRetryEntry(pbURL, entry); err != nil {
-					logError("Failed to update retry entry:", err.Error())
-				}
-				continue
-			}
-
-			listmonkBody, _ := io.ReadAll(listmonkResp.Body)
-			var listmonkCreateResp ListmonkCreateResponse
-			if err := json.NewDecoder(bytes.NewReader(listmonkBody)).Decode(&listmonkCreateResp); err != nil {
-				logError("Listmonk decode error:", fmt.Sprintf("Error: %v, Response: %s", err, string(listmonkBody)))
-				continue
-			}
-
-			phone := ""
-			if attribs, ok := listmonkCreateResp.Data.Attribs["phone"]; ok {
-				if phoneStr, ok := attribs.(string); ok {
-					phone = phoneStr
-				}
-			}
-			subscriber := SubscriberEntry{
-				UID:         listmonkCreateResp.Data.ID,
-				Email:       listmonkCreateResp.Data.Email,
-				Phone:       phone,
-				BonusStatus: false,
-			}
-			id, err := logToPocketBase(pbURL, "subscribers", subscriber, "")
-			if err != nil {
-				logError("Subscriber save error:", err.Error())
-				continue
-			}
-			subscriber.ID = id
-			log.Printf("Saved subscriber to PocketBase: UID=%d, Email=%s, Phone=%s", subscriber.UID, subscriber.Email, subscriber.Phone)
-
-			logEntry := LogEntry{
-				ErrorMessage: "Retry processed successfully",
-				Timestamp:    time.Now().Format(time.RFC3339),
-				Response:     fmt.Sprintf("Serial: %s, Event: %s", entry.Serial, entry.Event),
-			}
-			if _, err := logToPocketBase(pbURL, "logs", logEntry, ""); err != nil {
-				logError("Log save error:", err.Error())
-			} else {
-				log.Printf("Logged retry success: Serial=%s, Event=%s", entry.Serial, entry.Event)
-			}
-
-			if err := deleteRetryEntry(pbURL, entry.ID); err != nil {
-				logError("Failed to delete retry entry:", err.Error())
-			} else {
-				log.Printf("Deleted retry entry from PocketBase: ID=%s, Serial=%s", entry.ID, entry.Serial)
-			}
-		}
-
-		time.Sleep(30 * time.Second)
-	}
-}
-
-func deleteRetryEntry(pbURL, id string) error {
-	url := fmt.Sprintf("%s/api/collections/retry/records/%s", pbURL, id)
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("POCKETBASE_ADMIN_TOKEN"))
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("API error: %d, %s", resp.StatusCode, string(body))
-	}
-
-	log.Printf("Deleted retry entry from PocketBase: ID=%s", id)
-	return nil
-}
-
-func checkSubscriptions(pbURL, apiKey string) {
-	if pbURL == "" {
-		logError("POCKETBASE_URL is not set", "Cannot proceed with subscriptions check")
-		return
-	}
-	client := &http.Client{Timeout: 30 * time.Second}
+// checkSubscriptions is a single pass of the subscription scheduler: it hands every subscriber
+// still waiting for a campaign bonus to the workers and syncs the Listmonk lists of the active
+// campaigns once the sync interval has passed.
+func (a *App) checkSubscriptions(ctx context.Context) {
+	defer observeLoop("subscription_check", time.Now())
 
 	const workerCount = 10
 	var wg sync.WaitGroup
 	taskChan := make(chan SubscriberEntry, 2000)
 	processedUIDs := make(map[int]bool)
 
-	listIDStr := os.Getenv("LIST_ID")
-	listID, err := strconv.Atoi(listIDStr)
-	if err != nil {
-		logError("Invalid LIST_ID:", fmt.Sprintf("value: %s, error: %v", listIDStr, err))
-		return
-	}
-
 	for i := 0; i < workerCount; i++ {
 		wg.Add(1)
-		go worker(client, pbURL, apiKey, taskChan, &wg, listID)
+		go a.worker(ctx, taskChan, &wg)
 	}
 
-	for {
-		var allSubscribers []SubscriberEntry
-		page := 1
-		perPage := 30
-
-		for {
-			resp, err := client.Get(fmt.Sprintf("%s/api/collections/subscribers/records?page=%d&perPage=%d", pbURL, page, perPage))
-			if err != nil {
-				logError("PocketBase fetch subscribers error:", err.Error())
-				break
-			}
-			defer resp.Body.Close()
+	allSubscribers, err := listAll(ctx, a.subscribers.ListSubscribers, ListOptions{Filter: `bonus_status = false && status != "blocklisted"`, PerPage: 30})
+	if err != nil {
+		a.logError("PocketBase fetch subscribers error:", err.Error())
+	}
 
-			var subscribers struct {
-				Items      []SubscriberEntry `json:"items"`
-				Total      int               `json:"totalItems"`
-				Page       int               `json:"page"`
-				TotalPages int               `json:"totalPages"`
-			}
-			if err := json.NewDecoder(resp.Body).Decode(&subscribers); err != nil {
-				logError("PocketBase decode subscribers error:", err.Error())
-				break
-			}
+	// Инициализируем прогресс-бар
+	totalSubscribers := len(allSubscribers)
+	bar := progressbar.Default(int64(totalSubscribers), "Processing subscribers")
+	defer bar.Close()
 
-			allSubscribers = append(allSubscribers, subscribers.Items...)
-			if page >= subscribers.TotalPages {
-				break
-			}
-			page++
+	for _, sub := range allSubscribers {
+		if ctx.Err() != nil {
+			break
 		}
-
-		// Инициализируем прогресс-бар
-		totalSubscribers := len(allSubscribers)
-		bar := progressbar.Default(int64(totalSubscribers), "Processing subscribers")
-		defer bar.Close()
-
-		processedUIDs = make(map[int]bool)
-		for _, sub := range allSubscribers {
-			if !sub.BonusStatus && !processedUIDs[sub.UID] {
-				taskChan <- sub
-				processedUIDs[sub.UID] = true
-				bar.Add(1) // Обновляем прогресс-бар для каждого отправленного подписчика
-			}
+		if !sub.BonusStatus && !processedUIDs[sub.UID] {
+			taskChan <- sub
+			processedUIDs[sub.UID] = true
+			bar.Add(1) // Обновляем прогресс-бар для каждого отправленного подписчика
 		}
+	}
+	close(taskChan)
+	wg.Wait()
 
-		// Завершаем прогресс-бар перед синхронизацией
-		bar.Finish()
-
-		syncListmonkSubscribers(pbURL, os.Getenv("LISTMONK_API_URL"), os.Getenv("LISTMONK_USERNAME"), os.Getenv("LISTMONK_API_KEY"), listID)
+	// Завершаем прогресс-бар перед синхронизацией
+	bar.Finish()
 
-		time.Sleep(15 * time.Second)
+	if ctx.Err() == nil && time.Since(a.lastSync) >= a.syncInterval {
+		for _, listID := range a.activeListIDs(time.Now()) {
+			a.syncListmonkSubscribers(ctx, listID)
+		}
+		a.lastSync = time.Now()
 	}
 }
 
-func worker(client *http.Client, pbURL, apiKey string, taskChan <-chan SubscriberEntry, wg *sync.WaitGroup, expectedListID int) {
+func (a *App) worker(ctx context.Context, taskChan <-chan SubscriberEntry, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for sub := range taskChan {
-		listmonkURL := os.Getenv("LISTMONK_API_URL")
-		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(os.Getenv("LISTMONK_USERNAME")+":"+os.Getenv("LISTMONK_API_KEY")))
-		getURL := fmt.Sprintf("%s/%d", listmonkURL, sub.UID)
-		req, err := http.NewRequest("GET", getURL, nil)
-		if err != nil {
-			logError("Listmonk GET request error:", err.Error(), sub.UID)
-			addToRetry(pbURL, sub.Phone, "check_subscription", err.Error())
-			continue
-		}
-		req.Header.Set("Authorization", auth)
-
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		req = req.WithContext(ctx)
-		resp, err := client.Do(req)
-		if err != nil {
-			body := ""
-			if resp != nil {
-				bodyBytes, _ := io.ReadAll(resp.Body)
-				body = string(bodyBytes)
-				resp.Body.Close()
-			}
-			logError("Listmonk GET API error:", fmt.Sprintf("UID: %d, Status: %d, Error: %v, Body: %s", sub.UID, resp.StatusCode, err, body), sub.UID)
-			addToRetry(pbURL, sub.Phone, "check_subscription", fmt.Sprintf("Error: %v, Status: %d, Body: %s", err, resp.StatusCode, body))
-			cancel()
+		if ctx.Err() != nil {
 			continue
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			bodyBytes, _ := io.ReadAll(resp.Body)
-			logError("Listmonk GET API error:", fmt.Sprintf("UID: %d, Status: %d, Body: %s", sub.UID, resp.StatusCode, string(bodyBytes)), sub.UID)
-			addToRetry(pbURL, sub.Phone, "check_subscription", fmt.Sprintf("Status: %d, Body: %s", resp.StatusCode, string(bodyBytes)))
-			cancel()
-			continue
-		}
-
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			logError("Failed to read Listmonk response body:", err.Error(), sub.UID)
-			addToRetry(pbURL, sub.Phone, "check_subscription", err.Error())
-			cancel()
-			continue
-		}
-
-		var listmonkResp ListmonkGetResponse
-		if err := json.NewDecoder(bytes.NewReader(bodyBytes)).Decode(&listmonkResp); err != nil {
-			logError("Listmonk GET decode error:", fmt.Sprintf("UID: %d, Error: %v, Response: %s", sub.UID, err, string(bodyBytes)), sub.UID)
-			addToRetry(pbURL, sub.Phone, "check_subscription", fmt.Sprintf("Error: %v, Response: %s", err, string(bodyBytes)))
-			continue
-		}
-
-		isConfirmedForExpectedList := false
-		for _, list := range listmonkResp.Data.Lists {
-			if list.ID == expectedListID && list.SubscriptionStatus == "confirmed" {
-				isConfirmedForExpectedList = true
-				break
-			}
-		}
-
-		if isConfirmedForExpectedList {
-			mcrmURL := os.Getenv("MCRM_API_URL_BONUS")
-			bonusSum, err := strconv.ParseFloat(os.Getenv("BONUS_SUM"), 64)
-			if err != nil {
-				logError("Invalid BONUS_SUM:", err.Error(), sub.UID)
-				continue
-			}
-			payload := map[string]interface{}{
-				"number": sub.Phone,
-				"sum":    bonusSum,
-			}
-			jsonPayload, _ := json.Marshal(payload)
-
-			req, err = http.NewRequest("POST", mcrmURL, bytes.NewBuffer(jsonPayload))
-			if err != nil {
-				logError("MCRM bonus request error:", err.Error(), sub.UID)
-				continue
-			}
-			req.Header.Set("x-api-key", apiKey)
-			req.Header.Set("Content-Type", "application/json")
-
-			ctx, cancel = context.WithTimeout(context.Background(), 20*time.Second)
-			req = req.WithContext(ctx)
-			resp, err = client.Do(req)
-			if err != nil || resp.StatusCode != http.StatusOK {
-				body, _ := io.ReadAll(resp.Body)
-				logError("MCRM bonus API error:", fmt.Sprintf("UID: %d, Status: %d, Body: %s", sub.UID, resp.StatusCode, string(body)), sub.UID)
-				addToRetry(pbURL, sub.Phone, "bonus", fmt.Sprintf("Status: %d, Body: %s", resp.StatusCode, string(body)))
-				cancel()
-				continue
-			}
-			cancel()
-
-			sub.BonusStatus = true
-			if _, err := logToPocketBase(pbURL, "subscribers", sub, sub.ID); err != nil {
-				logError("Failed to update subscriber bonus status:", err.Error(), sub.UID)
-				continue
-			}
-			log.Printf("Updated subscriber in PocketBase: UID=%d, BonusStatus=true", sub.UID)
-		}
+		a.checkCampaigns(ctx, &sub)
 	}
 }
 
-func syncListmonkSubscribers(pbURL, listmonkURL, username, apiKey string, listID int) {
-	client := &http.Client{Timeout: 30 * time.Second}
+// newApp wires the clients and stores shared by the server and the subcommands.
+func newApp(cfg *Config, pb *PocketBase) (*App, error) {
+	app := &App{
+		config:      cfg,
+		pocketbase:  pb,
+		mcrm:        NewMCRMClient(cfg.MCRM.UserURL, cfg.MCRM.BonusURL, cfg.MCRM.APIKey),
+		listmonk:    NewListmonkClient(cfg.Listmonk.URL, cfg.Listmonk.Username, cfg.Listmonk.APIKey),
+		subscribers: pb,
+		retries:     pb,
+		logs:        pb,
+		idempotency: pb,
+		deadLetters: pb,
+		bonuses:     pb,
+		syncState:   pb,
+		backoff:     cfg.Backoff(),
+	}
+
+	app.retryHandlers = app.defaultRetryHandlers()
+	app.eventActions = app.defaultEventActions()
+	var err error
+	if app.mapper, err = NewSubscriberMapper(cfg.Mapping); err != nil {
+		return nil, err
+	}
+	app.syncInterval = cfg.Schedule.SyncInterval
+	return app, nil
+}
 
-	if listID <= 0 {
-		logError("Invalid listID:", fmt.Sprintf("listID=%d is not a valid identifier", listID))
-		return
+func main() {
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
 
-	cleanedURL := strings.TrimSuffix(listmonkURL, "/")
-	cleanedURL = strings.TrimSuffix(cleanedURL, "/subscribers")
-
-	const perPage = 1000
-
-	page := 1
-	for {
-		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+apiKey))
-		reqURL := fmt.Sprintf("%s/subscribers?list_id=%d&page=%d&per_page=%d", cleanedURL, listID, page, perPage)
-		req, err := http.NewRequest("GET", reqURL, nil)
-		if err != nil {
-			logError("Listmonk GET subscribers request error:", err.Error())
-			break
-		}
-		req.Header.Set("Authorization", auth)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		resp, err := client.Do(req)
-		if err != nil {
-			logError("Listmonk GET subscribers API request failed:", err.Error())
-			time.Sleep(5 * time.Minute)
-			break
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				logError("Failed to read Listmonk response body:", err.Error())
-			} else {
-				logError("Listmonk GET subscribers API error:", fmt.Sprintf("Status: %d, Body: %s", resp.StatusCode, string(body)))
-			}
-			time.Sleep(5 * time.Minute)
-			break
-		}
-
-		var listmonkResp struct {
-			Data struct {
-				Results []struct {
-					ID      int                    `json:"id"`
-					Email   string                 `json:"email"`
-					Attribs map[string]interface{} `json:"attribs"`
-					Phone   string                 `json:"phone"`
-					Status  string                 `json:"status"`
-					Lists   []struct {
-						ID int `json:"id"`
-					} `json:"lists"`
-				} `json:"results"`
-				Total   int `json:"total"`
-				PerPage int `json:"per_page"`
-				Page    int `json:"page"`
-			} `json:"data"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&listmonkResp); err != nil {
-			body, _ := io.ReadAll(resp.Body)
-			logError("Listmonk GET subscribers decode error:", fmt.Sprintf("Error: %v, Response: %s", err, string(body)))
-			time.Sleep(5 * time.Minute)
-			break
-		}
-
-		var allSubscribers []SubscriberEntry
-		pagePB := 1
-		for {
-			pbResp, err := client.Get(fmt.Sprintf("%s/api/collections/subscribers/records?page=%d&perPage=100", pbURL, pagePB))
-			if err != nil {
-				logError("Ошибка загрузки из PocketBase:", err.Error())
-				break
-			}
-			defer pbResp.Body.Close()
+	pb := NewPocketBase(cfg.PocketBase.URL, NewPocketBaseAuth(cfg.PocketBase.URL, cfg.PocketBase.Email, cfg.PocketBase.Password, cfg.PocketBase.AdminToken))
+	app, err := newApp(cfg, pb)
+	if err != nil {
+		log.Fatalf("Invalid field mapping: %v", err)
+	}
 
-			var subscribersPage struct {
-				Items []SubscriberEntry `json:"items"`
-				Total int               `json:"totalPages"`
-			}
-			if err := json.NewDecoder(pbResp.Body).Decode(&subscribersPage); err != nil {
-				logError("Ошибка декодирования данных из PocketBase:", err.Error())
-				break
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			if err := pb.Migrate(ctx); err != nil {
+				log.Fatalf("Migration failed: %v", err)
 			}
-
-			allSubscribers = append(allSubscribers, subscribersPage.Items...)
-			if pagePB >= subscribersPage.Total {
-				break
+		case "reconcile":
+			if err := app.runReconcile(ctx, os.Args[2:]); err != nil {
+				log.Fatalf("Reconciliation failed: %v", err)
 			}
-			pagePB++
-		}
-
-		existingSubscribers := make(map[int]SubscriberEntry)
-		for _, sub := range allSubscribers {
-			existingSubscribers[sub.UID] = sub
+		default:
+			log.Fatalf("Unknown command %q, expected no command, migrate or reconcile", os.Args[1])
 		}
+		return
+	}
 
-		for _, subscriber := range listmonkResp.Data.Results {
-			isInList := false
-			for _, list := range subscriber.Lists {
-				if list.ID == listID {
-					isInList = true
-					break
-				}
-			}
-			if !isInList {
-				continue
-			}
-
-			phone := ""
-			if attribs, ok := subscriber.Attribs["phone"]; ok {
-				if phoneStr, ok := attribs.(string); ok {
-					phone = phoneStr
-				}
-			}
-
-			newSubscriber := SubscriberEntry{
-				UID:         subscriber.ID,
-				Email:       subscriber.Email,
-				Phone:       phone,
-				BonusStatus: false,
-			}
+	e := echo.New()
 
-			if existingSub, exists := existingSubscribers[subscriber.ID]; exists {
-				if existingSub.Email != subscriber.Email || existingSub.Phone != phone {
-					existingSub.Email = subscriber.Email
-					existingSub.Phone = phone
-					if _, err := logToPocketBase(pbURL, "subscribers", existingSub, existingSub.ID); err != nil {
-						logError("Ошибка обновления подписчика:", err.Error())
-						continue
-					}
-					log.Printf("Updated subscriber in PocketBase: UID=%d, Email=%s, Phone=%s", subscriber.ID, subscriber.Email, phone)
-				}
-			} else {
-				id, err := logToPocketBase(pbURL, "subscribers", newSubscriber, "")
-				if err != nil {
-					logError("Ошибка сохранения нового подписчика:", err.Error())
-					continue
-				}
-				newSubscriber.ID = id
-				log.Printf("Saved new subscriber to PocketBase: UID=%d, Email=%s, Phone=%s", subscriber.ID, subscriber.Email, phone)
-			}
-		}
+	e.Use(middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
+		Skipper: skipAuth,
+		Validator: func(username, password string, c echo.Context) (bool, error) {
+			return credentialsMatch(username, password, cfg.Webhook.Username, cfg.Webhook.Password), nil
+		},
+	}))
 
-		if len(listmonkResp.Data.Results) == 0 || page*listmonkResp.Data.PerPage >= listmonkResp.Data.Total {
-			break
+	app.scheduler = NewScheduler("subscriptions", cfg.Schedule.CheckInterval, cfg.Schedule.CheckDebounce, app.checkSubscriptions)
+	app.queue = NewJobQueue(pb, cfg.Webhook.QueueSize, cfg.Webhook.Workers, app.runWebhookJob)
+	registerQueueMetrics(app.queue)
+
+	// Queued jobs get their own context so a signal lets them finish instead of aborting mid-pipeline.
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	app.queue.Start(jobCtx)
+
+	e.GET("/healthz", app.healthz)
+	e.GET("/readyz", app.readyz)
+	e.POST("/webhook", app.processWebhook)
+	e.GET("/admin/queue", app.queueStats)
+	e.GET("/admin/funnel", app.funnel)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	e.GET("/admin/dead-letters", app.listDeadLetters)
+	e.GET("/admin/dead-letters/:id", app.getDeadLetter)
+	e.POST("/admin/dead-letters/:id/requeue", app.requeueDeadLetter)
+	e.DELETE("/admin/dead-letters/:id", app.discardDeadLetter)
+
+	app.reconcileBonuses(ctx)
+
+	var background sync.WaitGroup
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		app.scheduler.Run(ctx)
+	}()
+	go func() {
+		defer background.Done()
+		app.processRetry(ctx)
+	}()
+
+	go func() {
+		if err := e.Start(cfg.ListenAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
 		}
+	}()
 
-		page++
-		time.Sleep(1 * time.Second)
-	}
+	<-ctx.Done()
+	stop()
+	log.Printf("Shutdown signal received, draining")
 
-	time.Sleep(1 * time.Hour)
-}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
 
-func main() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown error: %v", err)
 	}
+	if err := app.queue.Stop(shutdownCtx); err != nil {
+		log.Printf("Webhook queue drain incomplete, remaining jobs stay persisted: %v", err)
+	}
+	cancelJobs()
 
-	e := echo.New()
-
-	e.Use(middleware.BasicAuth(func(username, password string, c echo.Context) (bool, error) {
-		validUsername := os.Getenv("WEBHOOK_USERNAME")
-		validPassword := os.Getenv("WEBHOOK_PASSWORD")
-		return username == validUsername && password == validPassword, nil
-	}))
-
-	e.POST("/webhook", processWebhook)
-
-	go checkSubscriptions(os.Getenv("POCKETBASE_URL"), os.Getenv("MCRM_API_KEY"))
-	go processRetry(os.Getenv("POCKETBASE_URL"), os.Getenv("MCRM_API_KEY"))
-
-	log.Fatal(e.Start(":8080"))
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Printf("Shutdown complete")
+	case <-shutdownCtx.Done():
+		log.Printf("Shutdown deadline exceeded, background loops still running")
+	}
 }
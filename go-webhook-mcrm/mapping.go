@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// FieldMapping renders the Listmonk subscriber from the raw MCRM user JSON with Go templates,
+// e.g. "{{.first_name}} {{.last_name}}". An attrib template that is a single field reference
+// such as "{{.loyalty.points}}" keeps the JSON type of the value instead of rendering a string.
+// Nested references render empty when a parent object is missing.
+type FieldMapping struct {
+	Name    string            `yaml:"name"`
+	Email   string            `yaml:"email"`
+	Attribs map[string]string `yaml:"attribs"`
+}
+
+func defaultFieldMapping() FieldMapping {
+	return FieldMapping{
+		Name:  "{{.first_name}} {{.last_name}}",
+		Email: "{{.email}}",
+		Attribs: map[string]string{
+			"phone":       "{{.phone}}",
+			"card_number": "{{.card_number}}",
+		},
+	}
+}
+
+var fieldReference = regexp.MustCompile(`^\{\{\s*((?:\.[A-Za-z0-9_]+)+)\s*\}\}$`)
+
+type attribTemplate struct {
+	path []string
+	tmpl *template.Template
+}
+
+type SubscriberMapper struct {
+	name    *template.Template
+	email   *template.Template
+	attribs map[string]attribTemplate
+}
+
+func NewSubscriberMapper(m FieldMapping) (*SubscriberMapper, error) {
+	var errs []string
+	parse := func(field, text string) *template.Template {
+		tmpl, err := template.New(field).Option("missingkey=zero").Funcs(template.FuncMap{"get": getPath}).Parse(text)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("mapping.%s: %v", field, err))
+			return tmpl
+		}
+		safeFieldChains(tmpl.Tree.Root)
+		return tmpl
+	}
+
+	mapper := &SubscriberMapper{
+		name:    parse("name", m.Name),
+		email:   parse("email", m.Email),
+		attribs: make(map[string]attribTemplate, len(m.Attribs)),
+	}
+	if strings.TrimSpace(m.Email) == "" {
+		errs = append(errs, "mapping.email is required")
+	}
+	if _, ok := m.Attribs["phone"]; !ok {
+		errs = append(errs, "mapping.attribs.phone is required, bonuses are accrued by phone")
+	}
+
+	keys := make([]string, 0, len(m.Attribs))
+	for key := range m.Attribs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		text := m.Attribs[key]
+		if match := fieldReference.FindStringSubmatch(text); match != nil {
+			mapper.attribs[key] = attribTemplate{path: strings.Split(strings.TrimPrefix(match[1], "."), ".")}
+			continue
+		}
+		mapper.attribs[key] = attribTemplate{tmpl: parse("attribs."+key, text)}
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return mapper, nil
+}
+
+// Request builds the Listmonk subscriber for an MCRM user, subscribed to listIDs.
+func (m *SubscriberMapper) Request(user *MCRMResponse, listIDs []int) (ListmonkSubscriberRequest, error) {
+	data := user.Raw
+	if data == nil {
+		data = user.fields()
+	}
+
+	name, err := render(m.name, data)
+	if err != nil {
+		return ListmonkSubscriberRequest{}, err
+	}
+	email, err := render(m.email, data)
+	if err != nil {
+		return ListmonkSubscriberRequest{}, err
+	}
+	if email == "" {
+		return ListmonkSubscriberRequest{}, fmt.Errorf("mapped email is empty")
+	}
+
+	attribs := make(map[string]interface{}, len(m.attribs))
+	for key, attrib := range m.attribs {
+		if attrib.path != nil {
+			if value, ok := lookupPath(data, attrib.path); ok && value != nil {
+				attribs[key] = value
+			} else {
+				attribs[key] = ""
+			}
+			continue
+		}
+		value, err := render(attrib.tmpl, data)
+		if err != nil {
+			return ListmonkSubscriberRequest{}, err
+		}
+		attribs[key] = value
+	}
+
+	return ListmonkSubscriberRequest{
+		Email:   email,
+		Name:    strings.TrimSpace(name),
+		Status:  "enabled",
+		Lists:   listIDs,
+		Attribs: attribs,
+	}, nil
+}
+
+func render(tmpl *template.Template, data map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("mapping %s: %v", tmpl.Name(), err)
+	}
+	// missingkey=zero still prints "<no value>" for absent keys of an interface map.
+	return strings.TrimSpace(strings.ReplaceAll(buf.String(), "<no value>", "")), nil
+}
+
+func lookupPath(data map[string]interface{}, path []string) (interface{}, bool) {
+	var value interface{} = data
+	for _, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// getPath is the "get" template func, {{get . "address" "city"}} is empty when any key is missing.
+func getPath(data interface{}, path ...string) interface{} {
+	object, ok := data.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if value, ok := lookupPath(object, path); ok && value != nil {
+		return value
+	}
+	return ""
+}
+
+// safeFieldChains rewrites nested field references such as .address.city into get calls.
+// missingkey=zero only covers the last key, text/template fails on a field of a missing parent.
+func safeFieldChains(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			safeFieldChains(child)
+		}
+	case *parse.ActionNode:
+		safeFieldChains(n.Pipe)
+	case *parse.IfNode:
+		safeBranchFieldChains(&n.BranchNode)
+	case *parse.RangeNode:
+		safeBranchFieldChains(&n.BranchNode)
+	case *parse.WithNode:
+		safeBranchFieldChains(&n.BranchNode)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			safeFieldChains(cmd)
+		}
+	case *parse.CommandNode:
+		for i, arg := range n.Args {
+			if field, ok := arg.(*parse.FieldNode); ok && len(field.Ident) > 1 {
+				n.Args[i] = getCall(field)
+				continue
+			}
+			safeFieldChains(arg)
+		}
+	}
+}
+
+func safeBranchFieldChains(n *parse.BranchNode) {
+	safeFieldChains(n.Pipe)
+	safeFieldChains(n.List)
+	safeFieldChains(n.ElseList)
+}
+
+// getCall builds the parse tree of (get . "key"...) for a field chain.
+func getCall(field *parse.FieldNode) *parse.PipeNode {
+	args := []parse.Node{
+		parse.NewIdentifier("get").SetPos(field.Pos),
+		&parse.DotNode{NodeType: parse.NodeDot, Pos: field.Pos},
+	}
+	for _, key := range field.Ident {
+		args = append(args, &parse.StringNode{NodeType: parse.NodeString, Pos: field.Pos, Quoted: strconv.Quote(key), Text: key})
+	}
+	return &parse.PipeNode{
+		NodeType: parse.NodePipe,
+		Pos:      field.Pos,
+		Cmds:     []*parse.CommandNode{{NodeType: parse.NodeCommand, Pos: field.Pos, Args: args}},
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// MCRMAPI is the subset of the MCRM API used by the sync pipeline.
+type MCRMAPI interface {
+	GetUser(ctx context.Context, number string) (*MCRMResponse, error)
+	AccrueBonus(ctx context.Context, req MCRMBonusRequest) (*MCRMBonusResponse, error)
+	Ping(ctx context.Context) error
+}
+
+type MCRMUserRequest struct {
+	Number string `json:"number"`
+}
+
+type MCRMBonusRequest struct {
+	Number         string  `json:"number"`
+	Sum            float64 `json:"sum"`
+	IdempotencyKey string  `json:"-"`
+}
+
+// MCRMBonusResponse keeps the raw accrual response, MCRM does not document its shape.
+type MCRMBonusResponse struct {
+	Raw json.RawMessage
+}
+
+type MCRMErrorKind string
+
+const (
+	MCRMErrorTransport MCRMErrorKind = "transport"
+	MCRMErrorRedirect  MCRMErrorKind = "redirect"
+	MCRMErrorClient    MCRMErrorKind = "client"
+	MCRMErrorServer    MCRMErrorKind = "server"
+	MCRMErrorDecode    MCRMErrorKind = "decode"
+)
+
+type MCRMError struct {
+	Kind       MCRMErrorKind
+	URL        string
+	StatusCode int
+	Body       string
+	Err        error
+}
+
+func (e *MCRMError) Error() string {
+	switch e.Kind {
+	case MCRMErrorRedirect, MCRMErrorClient, MCRMErrorServer:
+		return fmt.Sprintf("MCRM %s error: Status: %d, Response: %s", e.Kind, e.StatusCode, e.Body)
+	case MCRMErrorDecode:
+		return fmt.Sprintf("MCRM decode error: Error: %v, Response: %s", e.Err, e.Body)
+	default:
+		return fmt.Sprintf("MCRM request error: %v", e.Err)
+	}
+}
+
+func (e *MCRMError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether repeating the same request may succeed. Timeouts and rate limiting
+// are the client errors that pass with time, an unfollowed redirect means a misconfigured URL.
+func (e *MCRMError) Retryable() bool {
+	switch e.Kind {
+	case MCRMErrorClient:
+		return e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+	case MCRMErrorRedirect:
+		return false
+	}
+	return true
+}
+
+// isPermanentMCRMError reports whether err wraps an MCRM error that no retry can fix.
+func isPermanentMCRMError(err error) bool {
+	var mcrmErr *MCRMError
+	return errors.As(err, &mcrmErr) && !mcrmErr.Retryable()
+}
+
+type MCRMClient struct {
+	userURL  string
+	bonusURL string
+	apiKey   string
+	client   *http.Client
+}
+
+func NewMCRMClient(userURL, bonusURL, apiKey string) *MCRMClient {
+	return &MCRMClient{
+		userURL:  userURL,
+		bonusURL: bonusURL,
+		apiKey:   apiKey,
+		client:   &http.Client{Timeout: 10 * time.Second, Transport: instrumentTransport("mcrm")},
+	}
+}
+
+func (m *MCRMClient) GetUser(ctx context.Context, number string) (*MCRMResponse, error) {
+	body, err := m.post(ctx, m.userURL, MCRMUserRequest{Number: number}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var user MCRMResponse
+	if err := json.Unmarshal(body, &user); err != nil {
+		return nil, &MCRMError{Kind: MCRMErrorDecode, URL: m.userURL, StatusCode: http.StatusOK, Body: string(body), Err: err}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&user.Raw); err != nil {
+		return nil, &MCRMError{Kind: MCRMErrorDecode, URL: m.userURL, StatusCode: http.StatusOK, Body: string(body), Err: err}
+	}
+	return &user, nil
+}
+
+func (m *MCRMClient) AccrueBonus(ctx context.Context, req MCRMBonusRequest) (*MCRMBonusResponse, error) {
+	body, err := m.post(ctx, m.bonusURL, req, req.IdempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &MCRMBonusResponse{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if !json.Valid(body) {
+			return nil, &MCRMError{Kind: MCRMErrorDecode, URL: m.bonusURL, StatusCode: http.StatusOK, Body: string(body), Err: fmt.Errorf("invalid JSON")}
+		}
+		resp.Raw = body
+	}
+	return resp, nil
+}
+
+// Ping checks that the MCRM user endpoint answers. MCRM has no health endpoint, so any
+// response below 500 counts as reachable.
+func (m *MCRMClient) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, m.userURL, nil)
+	if err != nil {
+		return &MCRMError{Kind: MCRMErrorTransport, URL: m.userURL, Err: err}
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return &MCRMError{Kind: MCRMErrorTransport, URL: m.userURL, Err: err}
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return &MCRMError{Kind: MCRMErrorServer, URL: m.userURL, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+func (m *MCRMClient) post(ctx context.Context, url string, payload interface{}, idempotencyKey string) ([]byte, error) {
+	if m.apiKey == "" {
+		return nil, &MCRMError{Kind: MCRMErrorTransport, URL: url, Err: fmt.Errorf("MCRM_API_KEY is not set")}
+	}
+
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, &MCRMError{Kind: MCRMErrorTransport, URL: url, Err: err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonPayload))
+	if err != nil {
+		return nil, &MCRMError{Kind: MCRMErrorTransport, URL: url, Err: err}
+	}
+	req.Header.Set("x-api-key", m.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, &MCRMError{Kind: MCRMErrorTransport, URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &MCRMError{Kind: MCRMErrorTransport, URL: url, StatusCode: resp.StatusCode, Err: err}
+	}
+
+	switch {
+	case resp.StatusCode >= 500:
+		return nil, &MCRMError{Kind: MCRMErrorServer, URL: url, StatusCode: resp.StatusCode, Body: string(body)}
+	case resp.StatusCode >= 400:
+		return nil, &MCRMError{Kind: MCRMErrorClient, URL: url, StatusCode: resp.StatusCode, Body: string(body)}
+	case resp.StatusCode >= 300:
+		return nil, &MCRMError{Kind: MCRMErrorRedirect, URL: url, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return body, nil
+}
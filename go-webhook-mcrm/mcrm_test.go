@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMCRMAccrueBonusStatus(t *testing.T) {
+	tests := []struct {
+		status    int
+		wantKind  MCRMErrorKind
+		retryable bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusCreated},
+		{status: http.StatusAccepted},
+		{status: http.StatusNoContent},
+		{status: http.StatusNotModified, wantKind: MCRMErrorRedirect},
+		{status: http.StatusBadRequest, wantKind: MCRMErrorClient},
+		{status: http.StatusNotFound, wantKind: MCRMErrorClient},
+		{status: http.StatusConflict, wantKind: MCRMErrorClient},
+		{status: http.StatusRequestTimeout, wantKind: MCRMErrorClient, retryable: true},
+		{status: http.StatusTooManyRequests, wantKind: MCRMErrorClient, retryable: true},
+		{status: http.StatusInternalServerError, wantKind: MCRMErrorServer, retryable: true},
+		{status: http.StatusServiceUnavailable, wantKind: MCRMErrorServer, retryable: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Idempotency-Key"); got != "bonus-1-spring" {
+					t.Errorf("Idempotency-Key = %q", got)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			client := NewMCRMClient(server.URL, server.URL, "key")
+			_, err := client.AccrueBonus(context.Background(), MCRMBonusRequest{Number: "1", Sum: 10, IdempotencyKey: "bonus-1-spring"})
+			if tt.wantKind == "" {
+				if err != nil {
+					t.Fatalf("AccrueBonus() = %v, want success", err)
+				}
+				return
+			}
+
+			var mcrmErr *MCRMError
+			if !errors.As(err, &mcrmErr) {
+				t.Fatalf("AccrueBonus() = %v, want an MCRMError", err)
+			}
+			if mcrmErr.Kind != tt.wantKind || mcrmErr.StatusCode != tt.status {
+				t.Errorf("error kind = %s, status %d, want %s", mcrmErr.Kind, mcrmErr.StatusCode, tt.wantKind)
+			}
+			if mcrmErr.Retryable() != tt.retryable || isPermanentMCRMError(err) == tt.retryable {
+				t.Errorf("Retryable() = %t, want %t", mcrmErr.Retryable(), tt.retryable)
+			}
+		})
+	}
+}
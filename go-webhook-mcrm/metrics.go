@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	webhooksReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_webhooks_received_total",
+		Help: "Webhooks accepted by POST /webhook.",
+	}, []string{"event"})
+
+	webhooksProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_webhooks_processed_total",
+		Help: "Webhooks finished by the pipeline, by outcome status (succeeded, retrying, failed, duplicate).",
+	}, []string{"event", "status"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sync_upstream_request_duration_seconds",
+		Help:    "Latency of calls to MCRM, Listmonk and PocketBase.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"upstream", "method", "endpoint", "status"})
+
+	retryQueueSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sync_retry_queue_size",
+		Help: "Retry entries stored in PocketBase at the last retry pass.",
+	})
+
+	deadLettersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_dead_letters_total",
+		Help: "Retry entries moved to the dead_letter collection.",
+	}, []string{"event"})
+
+	bonusesGranted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_bonuses_granted_total",
+		Help: "Bonuses accrued in MCRM.",
+	}, []string{"campaign"})
+
+	bonusSumGranted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sync_bonus_sum_granted_total",
+		Help: "Sum of the bonuses accrued in MCRM.",
+	}, []string{"campaign"})
+
+	loopDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sync_loop_duration_seconds",
+		Help:    "Duration of a single pass of the background loops.",
+		Buckets: []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1800},
+	}, []string{"loop"})
+)
+
+func observeLoop(loop string, started time.Time) {
+	loopDuration.WithLabelValues(loop).Observe(time.Since(started).Seconds())
+}
+
+// instrumentedTransport records the latency of every request made by an upstream client.
+type instrumentedTransport struct {
+	upstream string
+	next     http.RoundTripper
+}
+
+func instrumentTransport(upstream string) http.RoundTripper {
+	return &instrumentedTransport{upstream: upstream, next: http.DefaultTransport}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	started := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	upstreamDuration.WithLabelValues(t.upstream, req.Method, endpointLabel(req.URL.Path), status).Observe(time.Since(started).Seconds())
+	return resp, err
+}
+
+// endpointLabel replaces record and subscriber IDs in a path so the label stays low-cardinality.
+func endpointLabel(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(segment); err == nil || (i > 0 && segments[i-1] == "records") {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// eventLabel bounds the event label to the configured events, the name comes from the client.
+func (a *App) eventLabel(event string) string {
+	if _, ok := a.config.Events[event]; ok {
+		return event
+	}
+	return "unknown"
+}
+
+// registerQueueMetrics exposes the in-memory state of the webhook queue, read on every scrape.
+func registerQueueMetrics(q *JobQueue) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "sync_webhook_queue_depth",
+		Help: "Webhook jobs waiting in the in-memory queue.",
+	}, func() float64 { return float64(len(q.jobs)) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "sync_webhook_queue_in_flight",
+		Help: "Webhook jobs currently being processed.",
+	}, func() float64 { return float64(q.inFlight.Load()) })
+}
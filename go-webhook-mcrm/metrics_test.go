@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestEventLabel(t *testing.T) {
+	a := &App{config: &Config{Events: map[string]string{"registration": ActionSignup}}}
+
+	tests := map[string]string{
+		"registration":      "registration",
+		"purchase":          "unknown",
+		"":                  "unknown",
+		"registration\x00x": "unknown",
+	}
+	for event, want := range tests {
+		if got := a.eventLabel(event); got != want {
+			t.Errorf("eventLabel(%q) = %q, want %q", event, got, want)
+		}
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// migrationsCollection records the schema versions applied by the migrate subcommand.
+const migrationsCollection = "schema_migrations"
+
+// CollectionField is a field definition as accepted by the PocketBase collections API.
+type CollectionField map[string]interface{}
+
+func (f CollectionField) name() string {
+	name, _ := f["name"].(string)
+	return name
+}
+
+func (f CollectionField) fieldType() string {
+	fieldType, _ := f["type"].(string)
+	return fieldType
+}
+
+type CollectionSchema struct {
+	ID      string            `json:"id,omitempty"`
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Fields  []CollectionField `json:"fields"`
+	Indexes []string          `json:"indexes"`
+
+	// resolve merges records that would violate a unique index added to an existing collection.
+	// Without it such duplicates fail the migration.
+	resolve duplicateResolver
+	// drop names indexes of earlier versions this version removes.
+	drop []string
+}
+
+// duplicateResolver reduces a group of records sharing a unique key, oldest first, to one record.
+type duplicateResolver func(ctx context.Context, pb *PocketBase, collection string, group []json.RawMessage) error
+
+// Migration is a versioned set of collection definitions. Applying it creates missing
+// collections and adds missing fields and indexes, existing ones are never changed or dropped.
+// Records that would break a new unique index are merged first, see resolveDuplicates.
+type Migration struct {
+	Version     int
+	Name        string
+	Collections []CollectionSchema
+}
+
+type MigrationRecord struct {
+	ID        string `json:"id,omitempty"`
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	AppliedAt string `json:"applied_at"`
+}
+
+func textField(name string) CollectionField {
+	return CollectionField{"name": name, "type": "text"}
+}
+
+// longTextField holds API responses and error messages, which exceed the default limit of 5000 characters.
+func longTextField(name string) CollectionField {
+	return CollectionField{"name": name, "type": "text", "max": 100000}
+}
+
+func requiredTextField(name string) CollectionField {
+	return CollectionField{"name": name, "type": "text", "required": true}
+}
+
+func intField(name string) CollectionField {
+	return CollectionField{"name": name, "type": "number", "onlyInt": true}
+}
+
+func numberField(name string) CollectionField {
+	return CollectionField{"name": name, "type": "number"}
+}
+
+func boolField(name string) CollectionField {
+	return CollectionField{"name": name, "type": "bool"}
+}
+
+func jsonField(name string) CollectionField {
+	return CollectionField{"name": name, "type": "json"}
+}
+
+func dateField(name string) CollectionField {
+	return CollectionField{"name": name, "type": "date"}
+}
+
+// autodateFields adds the created and updated fields, which PocketBase no longer adds to base
+// collections on its own. The job queue is recovered in created order.
+func autodateFields() []CollectionField {
+	return []CollectionField{
+		{"name": "created", "type": "autodate", "onCreate": true, "onUpdate": false},
+		{"name": "updated", "type": "autodate", "onCreate": true, "onUpdate": true},
+	}
+}
+
+func baseCollection(name string, indexes []string, fields ...CollectionField) CollectionSchema {
+	return CollectionSchema{Name: name, Type: "base", Fields: append(fields, autodateFields()...), Indexes: indexes}
+}
+
+func (c CollectionSchema) resolvedBy(resolve duplicateResolver) CollectionSchema {
+	c.resolve = resolve
+	return c
+}
+
+func (c CollectionSchema) dropsIndexes(names ...string) CollectionSchema {
+	c.drop = names
+	return c
+}
+
+// migrations lists the schema history in order. Add a new version for schema changes instead
+// of editing an applied one.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial logs, retry and subscribers",
+		Collections: []CollectionSchema{
+			baseCollection("logs", nil,
+				longTextField("error_message"),
+				textField("timestamp"),
+				longTextField("response"),
+			),
+			baseCollection("retry", nil,
+				requiredTextField("serial"),
+				requiredTextField("event"),
+				intField("retry_count"),
+				longTextField("error_message"),
+				textField("timestamp"),
+			),
+			baseCollection("subscribers",
+				[]string{"CREATE UNIQUE INDEX `idx_subscribers_uid` ON `subscribers` (`uid`)"},
+				CollectionField{"name": "uid", "type": "number", "onlyInt": true, "required": true},
+				textField("email"),
+				textField("phone"),
+				boolField("bonus_status"),
+			).resolvedBy(mergeDuplicateSubscribers),
+		},
+	},
+	{
+		Version: 2,
+		Name:    "webhook pipeline: idempotency, job queue, retry backoff and dead letters",
+		Collections: []CollectionSchema{
+			baseCollection("idempotency",
+				[]string{
+					"CREATE UNIQUE INDEX `idx_idempotency_key` ON `idempotency` (`key`)",
+					"CREATE INDEX `idx_idempotency_request_key` ON `idempotency` (`request_key`)",
+				},
+				requiredTextField("key"),
+				textField("request_key"),
+				textField("serial"),
+				textField("event"),
+				textField("status"),
+				intField("status_code"),
+				longTextField("outcome"),
+				intField("subscriber_uid"),
+				textField("timestamp"),
+			),
+			baseCollection("webhook_jobs", nil,
+				requiredTextField("serial"),
+				requiredTextField("event"),
+				textField("request_key"),
+				textField("status"),
+				textField("timestamp"),
+			),
+			baseCollection("retry",
+				[]string{"CREATE INDEX `idx_retry_next_attempt_at` ON `retry` (`next_attempt_at`)"},
+				longTextField("last_error"),
+				dateField("next_attempt_at"),
+				intField("subscriber_uid"),
+				jsonField("attempts"),
+			),
+			baseCollection("dead_letter", nil,
+				textField("retry_id"),
+				textField("serial"),
+				textField("event"),
+				intField("subscriber_uid"),
+				jsonField("payload"),
+				jsonField("attempts"),
+				intField("retry_count"),
+				longTextField("last_error"),
+				textField("failed_at"),
+			),
+		},
+	},
+	{
+		Version: 3,
+		Name:    "bonus ledger, campaigns and event payloads",
+		Collections: []CollectionSchema{
+			baseCollection("bonus_ledger",
+				[]string{"CREATE UNIQUE INDEX `idx_bonus_ledger_key` ON `bonus_ledger` (`key`)"},
+				requiredTextField("key"),
+				textField("subscriber_id"),
+				intField("subscriber_uid"),
+				textField("campaign_id"),
+				intField("list_id"),
+				textField("phone"),
+				numberField("sum"),
+				textField("state"),
+				longTextField("response"),
+				longTextField("error"),
+				textField("timestamp"),
+			),
+			baseCollection("subscribers", nil,
+				jsonField("bonuses"),
+			),
+			// A subscriber has one pending retry per campaign, webhook retries have no campaign.
+			baseCollection("retry",
+				[]string{"CREATE UNIQUE INDEX `idx_retry_serial_event` ON `retry` (`serial`, `event`, `campaign_id`)"},
+				textField("campaign_id"),
+				jsonField("extra"),
+			).resolvedBy(keepLatestRetry),
+			baseCollection("webhook_jobs", nil,
+				textField("event_timestamp"),
+				jsonField("extra"),
+			),
+		},
+	},
+	{
+		Version: 4,
+		Name:    "incremental Listmonk sync watermarks",
+		Collections: []CollectionSchema{
+			baseCollection("sync_state",
+				[]string{"CREATE UNIQUE INDEX `idx_sync_state_key` ON `sync_state` (`key`)"},
+				requiredTextField("key"),
+				textField("watermark"),
+				intField("synced"),
+				textField("synced_at"),
+			),
+		},
+	},
+	{
+		Version: 5,
+		Name:    "subscriber status tracking",
+		Collections: []CollectionSchema{
+			baseCollection("subscribers",
+				[]string{"CREATE INDEX `idx_subscribers_status` ON `subscribers` (`status`)"},
+				textField("status"),
+				jsonField("lists"),
+				intField("bounces"),
+				jsonField("confirmed"),
+				textField("last_checked_at"),
+			),
+		},
+	},
+	{
+		Version: 6,
+		Name:    "per delivery idempotency keys",
+		Collections: []CollectionSchema{
+			baseCollection("webhook_jobs", nil,
+				textField("idempotency_key"),
+			),
+			// A subscriber has one pending retry per campaign and a webhook one per delivery, the
+			// v3 index allowed a single retry per card and event.
+			baseCollection("retry",
+				[]string{"CREATE UNIQUE INDEX `idx_retry_serial_event_campaign_id_idempotency_key` ON `retry` (`serial`, `event`, `campaign_id`, `idempotency_key`)"},
+				textField("idempotency_key"),
+			).resolvedBy(keepLatestRetry).dropsIndexes("idx_retry_serial_event"),
+		},
+	},
+}
+
+var indexName = regexp.MustCompile("(?i)^CREATE\\s+(?:UNIQUE\\s+)?INDEX\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?`?([A-Za-z0-9_]+)`?")
+
+func (pb *PocketBase) GetCollection(ctx context.Context, name string) (*CollectionSchema, error) {
+	var collection CollectionSchema
+	if err := pb.do(ctx, http.MethodGet, "/api/collections/"+url.PathEscape(name), nil, &collection); err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+func (pb *PocketBase) CreateCollection(ctx context.Context, collection CollectionSchema) error {
+	return pb.do(ctx, http.MethodPost, "/api/collections", collection, nil)
+}
+
+func (pb *PocketBase) UpdateCollection(ctx context.Context, collection CollectionSchema) error {
+	payload := map[string]interface{}{"fields": collection.Fields, "indexes": collection.Indexes}
+	return pb.do(ctx, http.MethodPatch, "/api/collections/"+url.PathEscape(collection.ID), payload, nil)
+}
+
+// ensureCollection creates the collection or adds the fields and indexes it is missing and removes
+// the indexes the version drops. It returns whether anything changed.
+func (pb *PocketBase) ensureCollection(ctx context.Context, want CollectionSchema) (bool, error) {
+	existing, err := pb.GetCollection(ctx, want.Name)
+	if errors.Is(err, ErrRecordNotFound) {
+		if err := pb.CreateCollection(ctx, want); err != nil {
+			return false, fmt.Errorf("failed to create collection %s: %v", want.Name, err)
+		}
+		log.Printf("Created PocketBase collection %s", want.Name)
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read collection %s: %v", want.Name, err)
+	}
+
+	fields := make(map[string]CollectionField, len(existing.Fields))
+	for _, field := range existing.Fields {
+		fields[field.name()] = field
+	}
+	var changes []string
+	indexes := make(map[string]bool, len(existing.Indexes))
+	kept := existing.Indexes[:0]
+	for _, index := range existing.Indexes {
+		match := indexName.FindStringSubmatch(index)
+		if match != nil && containsString(want.drop, match[1]) {
+			changes = append(changes, "-"+match[1])
+			continue
+		}
+		if match != nil {
+			indexes[match[1]] = true
+		}
+		kept = append(kept, index)
+	}
+	existing.Indexes = kept
+
+	for _, field := range want.Fields {
+		current, ok := fields[field.name()]
+		if !ok {
+			existing.Fields = append(existing.Fields, field)
+			changes = append(changes, field.name())
+			continue
+		}
+		if current.fieldType() != field.fieldType() {
+			log.Printf("PocketBase field %s.%s is %s instead of %s, leaving it unchanged", want.Name, field.name(), current.fieldType(), field.fieldType())
+		}
+	}
+	for _, index := range want.Indexes {
+		match := indexName.FindStringSubmatch(index)
+		if match == nil || indexes[match[1]] {
+			continue
+		}
+		if err := pb.resolveDuplicates(ctx, want, index); err != nil {
+			return false, err
+		}
+		existing.Indexes = append(existing.Indexes, index)
+		changes = append(changes, match[1])
+	}
+	if len(changes) == 0 {
+		return false, nil
+	}
+
+	if err := pb.UpdateCollection(ctx, *existing); err != nil {
+		return false, fmt.Errorf("failed to update collection %s: %v", want.Name, err)
+	}
+	log.Printf("Updated PocketBase collection %s, changed %v", want.Name, changes)
+	return true, nil
+}
+
+// Migrate applies the migrations newer than the latest recorded version. Collections are
+// ensured rather than blindly created, so running it against a hand made schema is safe.
+func (pb *PocketBase) Migrate(ctx context.Context) error {
+	if _, err := pb.ensureCollection(ctx, baseCollection(migrationsCollection,
+		[]string{"CREATE UNIQUE INDEX `idx_schema_migrations_version` ON `schema_migrations` (`version`)"},
+		CollectionField{"name": "version", "type": "number", "onlyInt": true, "required": true},
+		textField("name"),
+		textField("applied_at"),
+	)); err != nil {
+		return err
+	}
+
+	var applied RecordPage[MigrationRecord]
+	if err := pb.list(ctx, migrationsCollection, ListOptions{Sort: "-version", Page: 1, PerPage: 1}, &applied); err != nil {
+		return fmt.Errorf("failed to read applied migrations: %v", err)
+	}
+	current := 0
+	if len(applied.Items) > 0 {
+		current = applied.Items[0].Version
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+		log.Printf("Applying migration %d: %s", migration.Version, migration.Name)
+		for _, collection := range migration.Collections {
+			if _, err := pb.ensureCollection(ctx, collection); err != nil {
+				return fmt.Errorf("migration %d: %v", migration.Version, err)
+			}
+		}
+		record := MigrationRecord{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now().Format(time.RFC3339)}
+		if err := pb.create(ctx, migrationsCollection, record, nil); err != nil {
+			return fmt.Errorf("failed to record migration %d: %v", migration.Version, err)
+		}
+		current = migration.Version
+	}
+	log.Printf("PocketBase schema is at version %d", current)
+	return nil
+}
+
+var (
+	uniqueIndex  = regexp.MustCompile(`(?i)^CREATE\s+UNIQUE\s+INDEX`)
+	indexColumns = regexp.MustCompile(`\(([^)]*)\)\s*$`)
+)
+
+// resolveDuplicates makes sure the records of an existing collection satisfy a unique index
+// before it is added, as SQLite refuses to create it otherwise. Duplicates are merged by the
+// collection's resolver, or reported so they can be cleaned up by hand.
+func (pb *PocketBase) resolveDuplicates(ctx context.Context, want CollectionSchema, index string) error {
+	if !uniqueIndex.MatchString(index) {
+		return nil
+	}
+	match := indexColumns.FindStringSubmatch(index)
+	if match == nil {
+		return nil
+	}
+	var columns []string
+	for _, column := range strings.Split(match[1], ",") {
+		columns = append(columns, strings.Trim(strings.TrimSpace(column), "`\""))
+	}
+
+	groups, err := pb.findDuplicates(ctx, want.Name, columns)
+	if err != nil {
+		return fmt.Errorf("failed to check %s for duplicate %v: %v", want.Name, columns, err)
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	if want.resolve == nil {
+		var report []string
+		for i, group := range groups {
+			if i == 20 {
+				report = append(report, fmt.Sprintf("... and %d more", len(groups)-i))
+				break
+			}
+			report = append(report, group.String())
+		}
+		return fmt.Errorf("collection %s has %d groups of records with the same %v, which the unique index needs to be distinct: %s; "+
+			"delete or merge the duplicates in the PocketBase dashboard, then run migrate again",
+			want.Name, len(groups), columns, strings.Join(report, "; "))
+	}
+
+	for _, group := range groups {
+		if err := want.resolve(ctx, pb, want.Name, group.records); err != nil {
+			return fmt.Errorf("failed to merge duplicate %s records %s: %v", want.Name, group.String(), err)
+		}
+		log.Printf("Merged duplicate %s records %s", want.Name, group.String())
+	}
+	return nil
+}
+
+type duplicateGroup struct {
+	key     string
+	ids     []string
+	records []json.RawMessage
+}
+
+func (g duplicateGroup) String() string {
+	return fmt.Sprintf("%s: records %s", g.key, strings.Join(g.ids, ", "))
+}
+
+// findDuplicates groups the records of collection by the columns, oldest first. A column the
+// collection does not have yet counts as empty, like the value it is created with.
+func (pb *PocketBase) findDuplicates(ctx context.Context, collection string, columns []string) ([]duplicateGroup, error) {
+	list := func(ctx context.Context, opts ListOptions) (*RecordPage[json.RawMessage], error) {
+		var page RecordPage[json.RawMessage]
+		if err := pb.list(ctx, collection, opts, &page); err != nil {
+			return nil, err
+		}
+		return &page, nil
+	}
+	records, err := listAll(ctx, list, ListOptions{Sort: "created", PerPage: 500})
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string]*duplicateGroup)
+	var order []string
+	for _, raw := range records {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		parts := make([]string, len(columns))
+		for i, column := range columns {
+			value := fields[column]
+			if value == nil {
+				value = ""
+			}
+			parts[i] = fmt.Sprintf("%s=%v", column, value)
+		}
+		key := strings.Join(parts, " ")
+		group, ok := byKey[key]
+		if !ok {
+			group = &duplicateGroup{key: key}
+			byKey[key] = group
+			order = append(order, key)
+		}
+		id, _ := fields["id"].(string)
+		group.ids = append(group.ids, id)
+		group.records = append(group.records, raw)
+	}
+
+	var groups []duplicateGroup
+	for _, key := range order {
+		if group := byKey[key]; len(group.records) > 1 {
+			groups = append(groups, *group)
+		}
+	}
+	return groups, nil
+}
+
+// bonusStateRank orders campaign states by progress, so merging never turns a granted bonus
+// back into a pending one that would be paid twice.
+func bonusStateRank(state string) int {
+	switch state {
+	case CampaignGranted:
+		return 3
+	case CampaignExpired, CampaignCancelled:
+		return 2
+	case CampaignPending:
+		return 1
+	}
+	return 0
+}
+
+// mergeDuplicateSubscribers keeps the oldest subscriber record with the most advanced bonus
+// state per campaign found in any duplicate, and deletes the others.
+func mergeDuplicateSubscribers(ctx context.Context, pb *PocketBase, collection string, group []json.RawMessage) error {
+	subs := make([]SubscriberEntry, len(group))
+	for i, raw := range group {
+		if err := json.Unmarshal(raw, &subs[i]); err != nil {
+			return err
+		}
+	}
+
+	keep := subs[0]
+	for _, dup := range subs[1:] {
+		campaigns := map[string]bool{defaultCampaignID: true}
+		for id := range keep.Bonuses {
+			campaigns[id] = true
+		}
+		for id := range dup.Bonuses {
+			campaigns[id] = true
+		}
+		for id := range campaigns {
+			if state := dup.bonusState(id); bonusStateRank(state) > bonusStateRank(keep.bonusState(id)) {
+				keep.setBonusState(id, state)
+			}
+		}
+		if keep.Email == "" {
+			keep.Email = dup.Email
+		}
+		if keep.Phone == "" {
+			keep.Phone = dup.Phone
+		}
+	}
+
+	if err := pb.update(ctx, collection, keep.ID, keep, nil); err != nil {
+		return err
+	}
+	for _, dup := range subs[1:] {
+		if err := pb.delete(ctx, collection, dup.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepLatestRetry keeps the retry with the most attempts, which is the one processRetry has been
+// advancing, and deletes the copies.
+func keepLatestRetry(ctx context.Context, pb *PocketBase, collection string, group []json.RawMessage) error {
+	entries := make([]RetryEntry, len(group))
+	keep := 0
+	for i, raw := range group {
+		if err := json.Unmarshal(raw, &entries[i]); err != nil {
+			return err
+		}
+		if entries[i].RetryCount > entries[keep].RetryCount {
+			keep = i
+		}
+	}
+	for i, entry := range entries {
+		if i == keep {
+			continue
+		}
+		if err := pb.delete(ctx, collection, entry.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func migrationCollection(t *testing.T, version int, name string) CollectionSchema {
+	t.Helper()
+	for _, migration := range migrations {
+		if migration.Version != version {
+			continue
+		}
+		for _, collection := range migration.Collections {
+			if collection.Name == name {
+				return collection
+			}
+		}
+	}
+	t.Fatalf("migration %d has no collection %s", version, name)
+	return CollectionSchema{}
+}
+
+func TestEnsureCollectionReplacesRetryIndex(t *testing.T) {
+	const v3Index = "CREATE UNIQUE INDEX `idx_retry_serial_event` ON `retry` (`serial`, `event`, `campaign_id`)"
+	existing := CollectionSchema{
+		ID:   "retry1",
+		Name: "retry",
+		Type: "base",
+		Fields: []CollectionField{
+			textField("serial"),
+			textField("event"),
+			textField("campaign_id"),
+		},
+		Indexes: []string{
+			"CREATE INDEX `idx_retry_next_attempt_at` ON `retry` (`next_attempt_at`)",
+			v3Index,
+		},
+	}
+
+	var updated *CollectionSchema
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/collections/retry":
+			json.NewEncoder(w).Encode(existing)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/collections/retry/records":
+			json.NewEncoder(w).Encode(RecordPage[json.RawMessage]{Page: 1, PerPage: 100, TotalPages: 1})
+		case r.Method == http.MethodPatch && r.URL.Path == "/api/collections/retry1":
+			updated = &CollectionSchema{}
+			json.NewDecoder(r.Body).Decode(updated)
+			w.Write([]byte("{}"))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	pb := NewPocketBase(server.URL, NewPocketBaseAuth(server.URL, "", "", "token"))
+	if v3 := migrationCollection(t, 3, "retry"); !containsString(v3.Indexes, v3Index) {
+		t.Fatalf("migration 3 indexes = %v, want the applied %s", v3.Indexes, v3Index)
+	}
+
+	changed, err := pb.ensureCollection(context.Background(), migrationCollection(t, 6, "retry"))
+	if err != nil || !changed {
+		t.Fatalf("ensureCollection() = %t, %v", changed, err)
+	}
+	if updated == nil {
+		t.Fatal("collection was not updated")
+	}
+
+	indexes := strings.Join(updated.Indexes, "\n")
+	if strings.Contains(indexes, "`idx_retry_serial_event` ") {
+		t.Errorf("v3 index kept: %v", updated.Indexes)
+	}
+	if !strings.Contains(indexes, "idx_retry_serial_event_campaign_id_idempotency_key") || !strings.Contains(indexes, "idx_retry_next_attempt_at") {
+		t.Errorf("indexes = %v, want next_attempt_at and the per delivery index", updated.Indexes)
+	}
+	var fields []string
+	for _, field := range updated.Fields {
+		fields = append(fields, field.name())
+	}
+	if !containsString(fields, "idempotency_key") {
+		t.Errorf("fields = %v, want idempotency_key", fields)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrRecordNotFound = errors.New("record not found")
+	// ErrRecordExists is a create rejected by a unique index.
+	ErrRecordExists = errors.New("record already exists")
+)
+
+type ListOptions struct {
+	Filter  string
+	Sort    string
+	Page    int
+	PerPage int
+}
+
+type RecordPage[T any] struct {
+	Items      []T `json:"items"`
+	Page       int `json:"page"`
+	PerPage    int `json:"perPage"`
+	TotalItems int `json:"totalItems"`
+	TotalPages int `json:"totalPages"`
+}
+
+type SubscriberStore interface {
+	CreateSubscriber(ctx context.Context, sub *SubscriberEntry) error
+	UpdateSubscriber(ctx context.Context, sub *SubscriberEntry) error
+	DeleteSubscriber(ctx context.Context, id string) error
+	ListSubscribers(ctx context.Context, opts ListOptions) (*RecordPage[SubscriberEntry], error)
+	GetSubscriberByUID(ctx context.Context, uid int) (*SubscriberEntry, error)
+	GetSubscriberByPhone(ctx context.Context, phone string) (*SubscriberEntry, error)
+}
+
+type RetryStore interface {
+	CreateRetry(ctx context.Context, entry *RetryEntry) error
+	UpdateRetry(ctx context.Context, entry *RetryEntry) error
+	DeleteRetry(ctx context.Context, id string) error
+	ListRetries(ctx context.Context, opts ListOptions) (*RecordPage[RetryEntry], error)
+}
+
+type LogStore interface {
+	CreateLog(ctx context.Context, entry LogEntry) error
+}
+
+// listAll walks every page of a store listing, returning what was loaded so far on error.
+func listAll[T any](ctx context.Context, list func(context.Context, ListOptions) (*RecordPage[T], error), opts ListOptions) ([]T, error) {
+	if opts.PerPage <= 0 {
+		opts.PerPage = 100
+	}
+
+	var all []T
+	for page := 1; ; page++ {
+		opts.Page = page
+		result, err := list(ctx, opts)
+		if err != nil {
+			return all, err
+		}
+		all = append(all, result.Items...)
+		if len(result.Items) == 0 || page >= result.TotalPages {
+			return all, nil
+		}
+	}
+}
+
+// pbQuote renders a string literal for a PocketBase filter expression.
+func pbQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
+
+type PocketBaseError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *PocketBaseError) Error() string {
+	return fmt.Sprintf("PocketBase API error: %s %s, Status: %d, Response: %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+func (e *PocketBaseError) Is(target error) bool {
+	switch target {
+	case ErrRecordNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRecordExists:
+		return e.StatusCode == http.StatusBadRequest && strings.Contains(e.Body, "validation_not_unique")
+	}
+	return false
+}
+
+type PocketBase struct {
+	baseURL string
+	auth    *PocketBaseAuth
+	client  *http.Client
+}
+
+func NewPocketBase(baseURL string, auth *PocketBaseAuth) *PocketBase {
+	return &PocketBase{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		auth:    auth,
+		client:  &http.Client{Timeout: 10 * time.Second, Transport: instrumentTransport("pocketbase")},
+	}
+}
+
+func (pb *PocketBase) CreateSubscriber(ctx context.Context, sub *SubscriberEntry) error {
+	return pb.create(ctx, "subscribers", sub, sub)
+}
+
+func (pb *PocketBase) UpdateSubscriber(ctx context.Context, sub *SubscriberEntry) error {
+	return pb.update(ctx, "subscribers", sub.ID, sub, sub)
+}
+
+func (pb *PocketBase) DeleteSubscriber(ctx context.Context, id string) error {
+	return pb.delete(ctx, "subscribers", id)
+}
+
+func (pb *PocketBase) ListSubscribers(ctx context.Context, opts ListOptions) (*RecordPage[SubscriberEntry], error) {
+	var page RecordPage[SubscriberEntry]
+	if err := pb.list(ctx, "subscribers", opts, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (pb *PocketBase) GetSubscriberByUID(ctx context.Context, uid int) (*SubscriberEntry, error) {
+	var sub SubscriberEntry
+	if err := pb.first(ctx, "subscribers", fmt.Sprintf("uid = %d", uid), &sub); err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func (pb *PocketBase) GetSubscriberByPhone(ctx context.Context, phone string) (*SubscriberEntry, error) {
+	var sub SubscriberEntry
+	if err := pb.first(ctx, "subscribers", "phone = "+pbQuote(phone), &sub); err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func (pb *PocketBase) CreateRetry(ctx context.Context, entry *RetryEntry) error {
+	return pb.create(ctx, "retry", entry, entry)
+}
+
+func (pb *PocketBase) UpdateRetry(ctx context.Context, entry *RetryEntry) error {
+	return pb.update(ctx, "retry", entry.ID, entry, entry)
+}
+
+func (pb *PocketBase) DeleteRetry(ctx context.Context, id string) error {
+	return pb.delete(ctx, "retry", id)
+}
+
+func (pb *PocketBase) ListRetries(ctx context.Context, opts ListOptions) (*RecordPage[RetryEntry], error) {
+	var page RecordPage[RetryEntry]
+	if err := pb.list(ctx, "retry", opts, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (pb *PocketBase) CreateLog(ctx context.Context, entry LogEntry) error {
+	return pb.create(ctx, "logs", entry, nil)
+}
+
+func (pb *PocketBase) FindIdempotency(ctx context.Context, key, requestKey string) (*IdempotencyRecord, error) {
+	filter := "key = " + pbQuote(key)
+	if requestKey != "" {
+		filter += " || request_key = " + pbQuote(requestKey)
+	}
+	var record IdempotencyRecord
+	if err := pb.first(ctx, "idempotency", filter, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (pb *PocketBase) CreateIdempotency(ctx context.Context, record *IdempotencyRecord) error {
+	return pb.create(ctx, "idempotency", record, record)
+}
+
+func (pb *PocketBase) UpdateIdempotency(ctx context.Context, record *IdempotencyRecord) error {
+	return pb.update(ctx, "idempotency", record.ID, record, record)
+}
+
+func (pb *PocketBase) CreateJob(ctx context.Context, job *WebhookJob) error {
+	return pb.create(ctx, "webhook_jobs", job, job)
+}
+
+func (pb *PocketBase) UpdateJob(ctx context.Context, job *WebhookJob) error {
+	return pb.update(ctx, "webhook_jobs", job.ID, job, job)
+}
+
+func (pb *PocketBase) DeleteJob(ctx context.Context, id string) error {
+	return pb.delete(ctx, "webhook_jobs", id)
+}
+
+func (pb *PocketBase) ListJobs(ctx context.Context, opts ListOptions) (*RecordPage[WebhookJob], error) {
+	var page RecordPage[WebhookJob]
+	if err := pb.list(ctx, "webhook_jobs", opts, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (pb *PocketBase) CreateDeadLetter(ctx context.Context, letter *DeadLetter) error {
+	return pb.create(ctx, "dead_letter", letter, letter)
+}
+
+func (pb *PocketBase) GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	var letter DeadLetter
+	if err := pb.get(ctx, "dead_letter", id, &letter); err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+func (pb *PocketBase) DeleteDeadLetter(ctx context.Context, id string) error {
+	return pb.delete(ctx, "dead_letter", id)
+}
+
+func (pb *PocketBase) ListDeadLetters(ctx context.Context, opts ListOptions) (*RecordPage[DeadLetter], error) {
+	var page RecordPage[DeadLetter]
+	if err := pb.list(ctx, "dead_letter", opts, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (pb *PocketBase) FindBonus(ctx context.Context, key string) (*BonusLedgerEntry, error) {
+	var entry BonusLedgerEntry
+	if err := pb.first(ctx, "bonus_ledger", "key = "+pbQuote(key), &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (pb *PocketBase) CreateBonus(ctx context.Context, entry *BonusLedgerEntry) error {
+	return pb.create(ctx, "bonus_ledger", entry, entry)
+}
+
+func (pb *PocketBase) UpdateBonus(ctx context.Context, entry *BonusLedgerEntry) error {
+	return pb.update(ctx, "bonus_ledger", entry.ID, entry, entry)
+}
+
+func (pb *PocketBase) ListBonuses(ctx context.Context, opts ListOptions) (*RecordPage[BonusLedgerEntry], error) {
+	var page RecordPage[BonusLedgerEntry]
+	if err := pb.list(ctx, "bonus_ledger", opts, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (pb *PocketBase) GetSyncState(ctx context.Context, key string) (*SyncState, error) {
+	var state SyncState
+	if err := pb.first(ctx, "sync_state", "key = "+pbQuote(key), &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (pb *PocketBase) SaveSyncState(ctx context.Context, state *SyncState) error {
+	if state.ID == "" {
+		return pb.create(ctx, "sync_state", state, state)
+	}
+	return pb.update(ctx, "sync_state", state.ID, state, state)
+}
+
+// Ping checks that PocketBase is up and that the admin token can read the subscribers collection.
+func (pb *PocketBase) Ping(ctx context.Context) error {
+	if err := pb.do(ctx, http.MethodGet, "/api/health", nil, nil); err != nil {
+		return err
+	}
+	var page RecordPage[json.RawMessage]
+	return pb.list(ctx, "subscribers", ListOptions{Page: 1, PerPage: 1}, &page)
+}
+
+func (pb *PocketBase) get(ctx context.Context, collection, id string, out interface{}) error {
+	if id == "" {
+		return ErrRecordNotFound
+	}
+	return pb.do(ctx, http.MethodGet, fmt.Sprintf("/api/collections/%s/records/%s", collection, url.PathEscape(id)), nil, out)
+}
+
+func (pb *PocketBase) create(ctx context.Context, collection string, data, out interface{}) error {
+	return pb.do(ctx, http.MethodPost, fmt.Sprintf("/api/collections/%s/records", collection), data, out)
+}
+
+func (pb *PocketBase) update(ctx context.Context, collection, id string, data, out interface{}) error {
+	if id == "" {
+		return fmt.Errorf("cannot update %s record without ID", collection)
+	}
+	return pb.do(ctx, http.MethodPatch, fmt.Sprintf("/api/collections/%s/records/%s", collection, id), data, out)
+}
+
+func (pb *PocketBase) delete(ctx context.Context, collection, id string) error {
+	return pb.do(ctx, http.MethodDelete, fmt.Sprintf("/api/collections/%s/records/%s", collection, id), nil, nil)
+}
+
+func (pb *PocketBase) list(ctx context.Context, collection string, opts ListOptions, out interface{}) error {
+	params := url.Values{}
+	if opts.Page > 0 {
+		params.Set("page", strconv.Itoa(opts.Page))
+	}
+	if opts.PerPage > 0 {
+		params.Set("perPage", strconv.Itoa(opts.PerPage))
+	}
+	if opts.Filter != "" {
+		params.Set("filter", opts.Filter)
+	}
+	if opts.Sort != "" {
+		params.Set("sort", opts.Sort)
+	}
+	return pb.do(ctx, http.MethodGet, fmt.Sprintf("/api/collections/%s/records?%s", collection, params.Encode()), nil, out)
+}
+
+func (pb *PocketBase) first(ctx context.Context, collection, filter string, out interface{}) error {
+	var page RecordPage[json.RawMessage]
+	if err := pb.list(ctx, collection, ListOptions{Filter: filter, Page: 1, PerPage: 1}, &page); err != nil {
+		return err
+	}
+	if len(page.Items) == 0 {
+		return ErrRecordNotFound
+	}
+	return json.Unmarshal(page.Items[0], out)
+}
+
+// send performs one authenticated request, logging in again and repeating it once when
+// PocketBase rejects the cached token.
+func (pb *PocketBase) send(ctx context.Context, method, reqURL string, jsonData []byte) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := pb.auth.Token(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var body io.Reader
+		if jsonData != nil {
+			body = bytes.NewReader(jsonData)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		if jsonData != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := pb.client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 && pb.auth.Invalidate(token) {
+			log.Printf("PocketBase rejected the token, re-authenticating: %s %s", method, reqURL)
+			continue
+		}
+		return resp, respBody, nil
+	}
+}
+
+func (pb *PocketBase) do(ctx context.Context, method, path string, payload, out interface{}) error {
+	if pb.baseURL == "" {
+		return fmt.Errorf("POCKETBASE_URL is not set")
+	}
+	reqURL := pb.baseURL + path
+
+	var jsonData []byte
+	if payload != nil {
+		var err error
+		if jsonData, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	resp, respBody, err := pb.send(ctx, method, reqURL, jsonData)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return &PocketBaseError{Method: method, URL: reqURL, StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
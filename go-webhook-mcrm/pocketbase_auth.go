@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshBefore renews the superuser token this long before it expires.
+const refreshBefore = 5 * time.Minute
+
+// PocketBaseAuth hands out the token for PocketBase requests. With superuser credentials it logs
+// in through auth-with-password and keeps the token fresh, otherwise it returns the static token.
+type PocketBaseAuth struct {
+	baseURL     string
+	email       string
+	password    string
+	staticToken string
+	client      *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type pocketBaseAuthResponse struct {
+	Token string `json:"token"`
+}
+
+func NewPocketBaseAuth(baseURL, email, password, staticToken string) *PocketBaseAuth {
+	return &PocketBaseAuth{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		email:       email,
+		password:    password,
+		staticToken: staticToken,
+		client:      &http.Client{Timeout: 10 * time.Second, Transport: instrumentTransport("pocketbase")},
+	}
+}
+
+func (m *PocketBaseAuth) usesCredentials() bool {
+	return m.email != "" && m.password != ""
+}
+
+// Token returns a token valid for at least refreshBefore, refreshing or logging in again as needed.
+func (m *PocketBaseAuth) Token(ctx context.Context) (string, error) {
+	if !m.usesCredentials() {
+		return m.staticToken, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.token != "" && now.Add(refreshBefore).Before(m.expires) {
+		return m.token, nil
+	}
+
+	if m.token != "" && now.Before(m.expires) {
+		err := m.authenticate(ctx, "/api/collections/_superusers/auth-refresh", nil, m.token)
+		if err == nil {
+			return m.token, nil
+		}
+		log.Printf("PocketBase token refresh failed, logging in again: %v", err)
+	}
+
+	credentials := map[string]string{"identity": m.email, "password": m.password}
+	if err := m.authenticate(ctx, "/api/collections/_superusers/auth-with-password", credentials, ""); err != nil {
+		return "", err
+	}
+	return m.token, nil
+}
+
+// Invalidate drops the cached token after PocketBase rejected it, unless it was already replaced.
+func (m *PocketBaseAuth) Invalidate(token string) bool {
+	if !m.usesCredentials() {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token == token {
+		m.token = ""
+		m.expires = time.Time{}
+	}
+	return true
+}
+
+func (m *PocketBaseAuth) authenticate(ctx context.Context, path string, payload interface{}, bearer string) error {
+	var body io.Reader
+	if payload != nil {
+		jsonData, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(jsonData)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("PocketBase auth request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &PocketBaseError{Method: http.MethodPost, URL: m.baseURL + path, StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	var auth pocketBaseAuthResponse
+	if err := json.Unmarshal(respBody, &auth); err != nil || auth.Token == "" {
+		return fmt.Errorf("PocketBase auth decode error: %v, Response: %s", err, string(respBody))
+	}
+
+	m.token = auth.Token
+	m.expires = tokenExpiry(auth.Token)
+	log.Printf("Authenticated with PocketBase as superuser %s, token expires at %s", m.email, m.expires.Format(time.RFC3339))
+	return nil
+}
+
+// tokenExpiry reads the exp claim of a JWT without verifying it, assuming a short lifetime
+// for tokens without a readable claim.
+func tokenExpiry(token string) time.Time {
+	fallback := time.Now().Add(2 * refreshBefore)
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fallback
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fallback
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return fallback
+	}
+	return time.Unix(claims.Exp, 0)
+}
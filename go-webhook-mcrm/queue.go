@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+)
+
+var (
+	ErrQueueFull    = errors.New("webhook queue is full")
+	ErrQueueStopped = errors.New("webhook queue is stopped")
+)
+
+type WebhookJob struct {
+	ID             string                 `json:"id"`
+	Serial         string                 `json:"serial"`
+	Event          string                 `json:"event"`
+	EventTimestamp string                 `json:"event_timestamp"`
+	Extra          map[string]interface{} `json:"extra"`
+	RequestKey     string                 `json:"request_key"`
+	IdempotencyKey string                 `json:"idempotency_key"`
+	Status         string                 `json:"status"`
+	Timestamp      string                 `json:"timestamp"`
+}
+
+type JobStore interface {
+	CreateJob(ctx context.Context, job *WebhookJob) error
+	UpdateJob(ctx context.Context, job *WebhookJob) error
+	DeleteJob(ctx context.Context, id string) error
+	ListJobs(ctx context.Context, opts ListOptions) (*RecordPage[WebhookJob], error)
+}
+
+type QueueStats struct {
+	Depth     int   `json:"depth"`
+	Capacity  int   `json:"capacity"`
+	InFlight  int64 `json:"in_flight"`
+	Workers   int   `json:"workers"`
+	Persisted int   `json:"persisted"`
+	Processed int64 `json:"processed"`
+}
+
+// JobQueue persists every job to the store before handing it to the in-memory channel,
+// so jobs accepted before a crash are picked up again by Start.
+type JobQueue struct {
+	store     JobStore
+	jobs      chan WebhookJob
+	workers   int
+	handle    func(ctx context.Context, job WebhookJob)
+	inFlight  atomic.Int64
+	processed atomic.Int64
+	wg        sync.WaitGroup
+	mu        sync.RWMutex
+	stopped   bool
+}
+
+func NewJobQueue(store JobStore, size, workers int, handle func(ctx context.Context, job WebhookJob)) *JobQueue {
+	return &JobQueue{
+		store:   store,
+		jobs:    make(chan WebhookJob, size),
+		workers: workers,
+		handle:  handle,
+	}
+}
+
+func (q *JobQueue) Enqueue(ctx context.Context, job WebhookJob) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.stopped {
+		return ErrQueueStopped
+	}
+
+	job.Status = JobPending
+	job.Timestamp = time.Now().Format(time.RFC3339)
+	if err := q.store.CreateJob(ctx, &job); err != nil {
+		return err
+	}
+
+	select {
+	case q.jobs <- job:
+		log.Printf("Enqueued webhook job: ID=%s, Serial=%s, Event=%s", job.ID, job.Serial, job.Event)
+		return nil
+	default:
+		if err := q.store.DeleteJob(ctx, job.ID); err != nil {
+			log.Printf("Failed to delete rejected webhook job: ID=%s, Error: %v", job.ID, err)
+		}
+		return ErrQueueFull
+	}
+}
+
+// Start launches the worker pool and re-enqueues jobs persisted by a previous run.
+func (q *JobQueue) Start(ctx context.Context) {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.worker(ctx)
+	}
+
+	pending, err := listAll(ctx, q.store.ListJobs, ListOptions{Sort: "created"})
+	if err != nil {
+		log.Printf("Failed to load persisted webhook jobs: %v", err)
+	}
+	if len(pending) > 0 {
+		log.Printf("Recovering %d persisted webhook jobs", len(pending))
+		go func() {
+			for _, job := range pending {
+				if !q.push(job) {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// push blocks until the recovered job fits in the channel, giving up once Stop was called.
+func (q *JobQueue) push(job WebhookJob) bool {
+	for {
+		q.mu.RLock()
+		if q.stopped {
+			q.mu.RUnlock()
+			return false
+		}
+		select {
+		case q.jobs <- job:
+			q.mu.RUnlock()
+			return true
+		default:
+		}
+		q.mu.RUnlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Stop rejects new jobs and waits for the workers to drain the channel. Jobs still
+// buffered when ctx expires remain persisted and are recovered by the next Start.
+func (q *JobQueue) Stop(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *JobQueue) worker(ctx context.Context) {
+	defer q.wg.Done()
+
+	for job := range q.jobs {
+		if ctx.Err() != nil {
+			// Left persisted for the next Start, which recovers every stored job.
+			continue
+		}
+		q.inFlight.Add(1)
+
+		job.Status = JobRunning
+		if err := q.store.UpdateJob(ctx, &job); err != nil {
+			log.Printf("Failed to mark webhook job running: ID=%s, Error: %v", job.ID, err)
+		}
+
+		q.handle(ctx, job)
+
+		if ctx.Err() != nil {
+			log.Printf("Webhook job cancelled, left persisted: ID=%s, Serial=%s, Event=%s", job.ID, job.Serial, job.Event)
+		} else if err := q.store.DeleteJob(ctx, job.ID); err != nil {
+			log.Printf("Failed to delete finished webhook job: ID=%s, Error: %v", job.ID, err)
+		}
+		q.processed.Add(1)
+		q.inFlight.Add(-1)
+	}
+}
+
+// HasJob reports whether a persisted job carries the idempotency key.
+func (q *JobQueue) HasJob(ctx context.Context, idempotencyKey string) (bool, error) {
+	page, err := q.store.ListJobs(ctx, ListOptions{Page: 1, PerPage: 1, Filter: "idempotency_key = " + pbQuote(idempotencyKey)})
+	if err != nil {
+		return false, err
+	}
+	return len(page.Items) > 0, nil
+}
+
+func (q *JobQueue) Stats(ctx context.Context) QueueStats {
+	stats := QueueStats{
+		Depth:     len(q.jobs),
+		Capacity:  cap(q.jobs),
+		InFlight:  q.inFlight.Load(),
+		Workers:   q.workers,
+		Processed: q.processed.Load(),
+	}
+	if page, err := q.store.ListJobs(ctx, ListOptions{Page: 1, PerPage: 1}); err == nil {
+		stats.Persisted = page.TotalItems
+	}
+	return stats
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Kinds of differences between Listmonk and PocketBase found by reconciliation.
+const (
+	IssueMissing        = "missing"
+	IssueOrphaned       = "orphaned"
+	IssueFieldMismatch  = "field_mismatch"
+	IssueStatusMismatch = "status_mismatch"
+)
+
+// ReconcileIssue is one difference. Listmonk is the source of truth, Fix describes what
+// applying the report changes in PocketBase.
+type ReconcileIssue struct {
+	Kind       string `json:"kind"`
+	UID        int    `json:"uid"`
+	Email      string `json:"email"`
+	Field      string `json:"field,omitempty"`
+	Listmonk   string `json:"listmonk,omitempty"`
+	PocketBase string `json:"pocketbase,omitempty"`
+	Fix        string `json:"fix"`
+	Applied    bool   `json:"applied"`
+	Error      string `json:"error,omitempty"`
+}
+
+type ReconcileReport struct {
+	GeneratedAt           string           `json:"generated_at"`
+	DryRun                bool             `json:"dry_run"`
+	ListIDs               []int            `json:"list_ids"`
+	ListmonkSubscribers   int              `json:"listmonk_subscribers"`
+	PocketBaseSubscribers int              `json:"pocketbase_subscribers"`
+	Summary               map[string]int   `json:"summary"`
+	Issues                []ReconcileIssue `json:"issues"`
+}
+
+// listmonkMember is a Listmonk subscriber with its subscription status and confirmation date per list.
+type listmonkMember struct {
+	UID       int
+	Email     string
+	Phone     string
+	Status    string
+	Lists     map[int]string
+	Confirmed map[int]string
+}
+
+// subscribed reports whether the member is on listID and has not unsubscribed from it.
+func (m *listmonkMember) subscribed(listID int) bool {
+	status, ok := m.Lists[listID]
+	return ok && status != SubscriptionUnsubscribed && m.Status != SubscriberBlocklisted
+}
+
+// listStatus describes the member's standing on listID for the report.
+func (m *listmonkMember) listStatus(listID int) string {
+	if m.Status == SubscriberBlocklisted {
+		return SubscriberBlocklisted
+	}
+	if status, ok := m.Lists[listID]; ok {
+		return status
+	}
+	return "not in list"
+}
+
+// runReconcile implements the reconcile subcommand:
+//
+//	reconcile [-format json|csv] [-output file] [-apply]
+//
+// Without -apply it only writes the report.
+func (a *App) runReconcile(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	format := flags.String("format", "json", "report format, json or csv")
+	output := flags.String("output", "-", "report file, - for stdout")
+	apply := flags.Bool("apply", false, "apply the fixes to PocketBase instead of a dry run")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("unknown report format %q, expected json or csv", *format)
+	}
+
+	report, err := a.reconcileSubscribers(ctx, *apply)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	if *format == "csv" {
+		return writeReconcileCSV(w, report)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// reconcileSubscribers diffs the subscribers of every campaign list in Listmonk against
+// PocketBase and, with apply set, fixes PocketBase to match Listmonk.
+func (a *App) reconcileSubscribers(ctx context.Context, apply bool) (*ReconcileReport, error) {
+	now := time.Now()
+	listIDs := campaignListIDs(a.config.Campaigns)
+
+	members, err := a.loadListmonkMembers(ctx, listIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Listmonk subscribers: %v", err)
+	}
+	listmonkCount := len(members)
+
+	stored, err := listAll(ctx, a.subscribers.ListSubscribers, ListOptions{PerPage: 100})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load PocketBase subscribers: %v", err)
+	}
+
+	report := &ReconcileReport{
+		GeneratedAt:           now.Format(time.RFC3339),
+		DryRun:                !apply,
+		ListIDs:               listIDs,
+		ListmonkSubscribers:   listmonkCount,
+		PocketBaseSubscribers: len(stored),
+		Summary:               make(map[string]int),
+		Issues:                []ReconcileIssue{},
+	}
+
+	seen := make(map[int]bool, len(stored))
+	for i := range stored {
+		sub := &stored[i]
+		seen[sub.UID] = true
+
+		member, ok := members[sub.UID]
+		if !ok {
+			// Not on any campaign list, so look the subscriber up to tell a deleted one apart
+			// from one that was removed from the lists.
+			resp, err := a.listmonk.GetSubscriber(ctx, sub.UID)
+			switch {
+			case IsListmonkStatus(err, http.StatusNotFound):
+				issue := ReconcileIssue{Kind: IssueOrphaned, UID: sub.UID, Email: sub.Email, PocketBase: sub.ID, Fix: "delete PocketBase subscriber"}
+				if apply {
+					a.applyReconcile([]*ReconcileIssue{&issue}, func() error { return a.subscribers.DeleteSubscriber(ctx, sub.ID) })
+				}
+				report.add(issue)
+				continue
+			case err != nil:
+				return nil, fmt.Errorf("failed to look up Listmonk subscriber %d: %v", sub.UID, err)
+			}
+			member = memberFromGet(resp)
+		}
+
+		var issues []*ReconcileIssue
+		if sub.Email != member.Email {
+			issues = append(issues, &ReconcileIssue{Kind: IssueFieldMismatch, UID: sub.UID, Email: member.Email, Field: "email", Listmonk: member.Email, PocketBase: sub.Email, Fix: "update email"})
+		}
+		if sub.Phone != member.Phone {
+			issues = append(issues, &ReconcileIssue{Kind: IssueFieldMismatch, UID: sub.UID, Email: member.Email, Field: "phone", Listmonk: member.Phone, PocketBase: sub.Phone, Fix: "update phone"})
+		}
+		if sub.Status != member.Status {
+			issues = append(issues, &ReconcileIssue{Kind: IssueStatusMismatch, UID: sub.UID, Email: member.Email, Field: "status", Listmonk: member.Status, PocketBase: sub.Status, Fix: "update status"})
+		}
+		pending := sub.pendingCampaigns()
+		sort.Strings(pending)
+		var cancelled []string
+		for _, id := range pending {
+			campaign, ok := a.campaign(id)
+			if !ok || member.subscribed(campaign.ListID) {
+				continue
+			}
+			cancelled = append(cancelled, id)
+			issues = append(issues, &ReconcileIssue{Kind: IssueStatusMismatch, UID: sub.UID, Email: member.Email, Field: "bonuses." + id, Listmonk: member.listStatus(campaign.ListID), PocketBase: CampaignPending, Fix: "cancel pending bonus"})
+		}
+		if len(issues) == 0 {
+			continue
+		}
+
+		if apply {
+			a.applyReconcile(issues, func() error {
+				sub.Email = member.Email
+				sub.Phone = member.Phone
+				sub.updateListmonkStatus(member.Status, member.Lists, member.Confirmed)
+				for _, id := range cancelled {
+					sub.setBonusState(id, CampaignCancelled)
+				}
+				return a.subscribers.UpdateSubscriber(ctx, sub)
+			})
+		}
+		for _, issue := range issues {
+			report.add(*issue)
+		}
+	}
+
+	uids := make([]int, 0, len(members))
+	for uid := range members {
+		if !seen[uid] {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Ints(uids)
+	for _, uid := range uids {
+		member := members[uid]
+		if !anySubscribed(member, listIDs) {
+			continue
+		}
+
+		issue := ReconcileIssue{Kind: IssueMissing, UID: uid, Email: member.Email, Listmonk: member.Status, Fix: "create PocketBase subscriber"}
+		if apply {
+			a.applyReconcile([]*ReconcileIssue{&issue}, func() error {
+				sub := SubscriberEntry{UID: uid, Email: member.Email, Phone: member.Phone, Bonuses: make(map[string]string)}
+				sub.updateListmonkStatus(member.Status, member.Lists, member.Confirmed)
+				for _, listID := range listIDs {
+					if member.subscribed(listID) {
+						sub.enroll(a.campaignsForList(listID, now))
+					}
+				}
+				return a.subscribers.CreateSubscriber(ctx, &sub)
+			})
+		}
+		report.add(issue)
+	}
+
+	log.Printf("Reconciliation finished: Listmonk=%d, PocketBase=%d, Issues=%v, DryRun=%t", listmonkCount, len(stored), report.Summary, !apply)
+	return report, nil
+}
+
+func (r *ReconcileReport) add(issue ReconcileIssue) {
+	r.Issues = append(r.Issues, issue)
+	r.Summary[issue.Kind]++
+}
+
+// applyReconcile runs one fix and records its result on every issue it resolves.
+func (a *App) applyReconcile(issues []*ReconcileIssue, fix func() error) {
+	if err := fix(); err != nil {
+		a.logError("Reconciliation fix error:", err.Error(), issues[0].UID)
+		for _, issue := range issues {
+			issue.Error = err.Error()
+		}
+		return
+	}
+	for _, issue := range issues {
+		issue.Applied = true
+	}
+	log.Printf("Reconciled subscriber: UID=%d, Fixes=%d", issues[0].UID, len(issues))
+}
+
+func anySubscribed(member *listmonkMember, listIDs []int) bool {
+	for _, listID := range listIDs {
+		if member.subscribed(listID) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadListmonkMembers pages through every list and merges the subscribers by ID.
+func (a *App) loadListmonkMembers(ctx context.Context, listIDs []int) (map[int]*listmonkMember, error) {
+	members := make(map[int]*listmonkMember)
+	for _, listID := range listIDs {
+		query := ListmonkSubscriberQuery{ListID: listID, OrderBy: "id", Order: "asc", PerPage: 1000}
+		for query.Page = 1; ; query.Page++ {
+			resp, err := a.listmonk.ListSubscribers(ctx, query)
+			if err != nil {
+				return nil, err
+			}
+			for _, subscriber := range resp.Data.Results {
+				if _, ok := members[subscriber.ID]; ok {
+					continue
+				}
+				lists, confirmed := subscriptionsByList(subscriber.Lists)
+				members[subscriber.ID] = &listmonkMember{
+					UID:       subscriber.ID,
+					Email:     subscriber.Email,
+					Phone:     attribString(subscriber.Attribs, "phone"),
+					Status:    subscriber.Status,
+					Lists:     lists,
+					Confirmed: confirmed,
+				}
+			}
+			if len(resp.Data.Results) == 0 || query.Page*resp.Data.PerPage >= resp.Data.Total {
+				break
+			}
+		}
+	}
+	return members, nil
+}
+
+func memberFromGet(resp *ListmonkGetResponse) *listmonkMember {
+	lists, confirmed := subscriptionsByList(resp.Data.Lists)
+	return &listmonkMember{
+		UID:       resp.Data.ID,
+		Email:     resp.Data.Email,
+		Phone:     attribString(resp.Data.Attribs, "phone"),
+		Status:    resp.Data.Status,
+		Lists:     lists,
+		Confirmed: confirmed,
+	}
+}
+
+func writeReconcileCSV(w io.Writer, report *ReconcileReport) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"kind", "uid", "email", "field", "listmonk", "pocketbase", "fix", "applied", "error"}); err != nil {
+		return err
+	}
+	for _, issue := range report.Issues {
+		record := []string{
+			issue.Kind,
+			strconv.Itoa(issue.UID),
+			issue.Email,
+			issue.Field,
+			issue.Listmonk,
+			issue.PocketBase,
+			issue.Fix,
+			strconv.FormatBool(issue.Applied),
+			issue.Error,
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// pbDateTime is the layout PocketBase uses for datetime values and the @now filter macro.
+const pbDateTime = "2006-01-02 15:04:05.000Z"
+
+// BackoffPolicy computes the delay before the next retry attempt: Base*Factor^attempt,
+// capped at Max and spread by ±Jitter (a fraction of the delay).
+type BackoffPolicy struct {
+	Base   time.Duration
+	Factor float64
+	Max    time.Duration
+	Jitter float64
+}
+
+func (p BackoffPolicy) Delay(attempt int) time.Duration {
+	delay := float64(p.Base) * math.Pow(p.Factor, float64(attempt))
+	if p.Max > 0 && delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(delay)
+}
+
+func (p BackoffPolicy) NextAttemptAt(attempt int) string {
+	return time.Now().Add(p.Delay(attempt)).UTC().Format(pbDateTime)
+}
+
+const (
+	RetryEventBonus             = "bonus"
+	RetryEventCheckSubscription = "check_subscription"
+)
+
+// RetryHandler replays the step that failed for a retry entry.
+type RetryHandler func(ctx context.Context, entry RetryEntry) error
+
+// defaultRetryHandlers maps internal retry events to their step, any other event is a webhook replay.
+func (a *App) defaultRetryHandlers() map[string]RetryHandler {
+	return map[string]RetryHandler{
+		RetryEventBonus:             a.retryBonus,
+		RetryEventCheckSubscription: a.retryCheckSubscription,
+	}
+}
+
+func (a *App) retryHandler(event string) RetryHandler {
+	if handler, ok := a.retryHandlers[event]; ok {
+		return handler
+	}
+	return a.retryWebhook
+}
+
+func (a *App) addToRetry(ev WebhookEvent, key, errorMessage string) error {
+	return a.saveRetry(RetryEntry{Serial: ev.Serial, Event: ev.Event, IdempotencyKey: key, Extra: ev.Extra, ErrorMessage: errorMessage})
+}
+
+func (a *App) addSubscriberRetry(sub SubscriberEntry, campaignID, event, errorMessage string) error {
+	return a.saveRetry(RetryEntry{Serial: sub.Phone, Event: event, SubscriberUID: sub.UID, CampaignID: campaignID, ErrorMessage: errorMessage})
+}
+
+func (a *App) saveRetry(retryEntry RetryEntry) error {
+	retryEntry.RetryCount = 0
+	retryEntry.LastError = retryEntry.ErrorMessage
+	retryEntry.NextAttemptAt = a.backoff.NextAttemptAt(0)
+	retryEntry.Timestamp = time.Now().Format(time.RFC3339)
+	err := a.retries.CreateRetry(context.Background(), &retryEntry)
+	if errors.Is(err, ErrRecordExists) {
+		return a.rescheduleExistingRetry(context.Background(), retryEntry)
+	}
+	if err != nil {
+		a.logError("Retry save error:", err.Error())
+		return err
+	}
+	log.Printf("Added retry entry to PocketBase: Serial=%s, Event=%s, ID=%s", retryEntry.Serial, retryEntry.Event, retryEntry.ID)
+	return nil
+}
+
+// rescheduleExistingRetry folds a failure into the retry entry that already owns the same
+// serial, event, campaign and delivery, moving its next attempt up when the new one is sooner.
+func (a *App) rescheduleExistingRetry(ctx context.Context, retryEntry RetryEntry) error {
+	filter := fmt.Sprintf("serial = %s && event = %s && campaign_id = %s && idempotency_key = %s",
+		pbQuote(retryEntry.Serial), pbQuote(retryEntry.Event), pbQuote(retryEntry.CampaignID), pbQuote(retryEntry.IdempotencyKey))
+	page, err := a.retries.ListRetries(ctx, ListOptions{Page: 1, PerPage: 1, Filter: filter})
+	if err == nil && len(page.Items) == 0 {
+		err = ErrRecordNotFound
+	}
+	if err != nil {
+		a.logError("Retry save error:", fmt.Sprintf("existing entry lookup for Serial: %s, Event: %s: %v", retryEntry.Serial, retryEntry.Event, err))
+		return err
+	}
+
+	existing := page.Items[0]
+	existing.LastError = retryEntry.LastError
+	if existing.NextAttemptAt == "" || retryEntry.NextAttemptAt < existing.NextAttemptAt {
+		existing.NextAttemptAt = retryEntry.NextAttemptAt
+	}
+	if err := a.retries.UpdateRetry(ctx, &existing); err != nil {
+		a.logError("Failed to update retry entry:", err.Error())
+		return err
+	}
+	log.Printf("Rescheduled existing retry entry: ID=%s, Serial=%s, Event=%s, NextAttemptAt=%s", existing.ID, existing.Serial, existing.Event, existing.NextAttemptAt)
+	return nil
+}
+
+func (a *App) updateRetryEntry(ctx context.Context, entry RetryEntry) {
+	if err := a.retries.UpdateRetry(ctx, &entry); err != nil {
+		a.logError("Failed to update retry entry:", err.Error())
+		return
+	}
+	log.Printf("Updated retry entry in PocketBase: ID=%s, Serial=%s, RetryCount=%d, NextAttemptAt=%s", entry.ID, entry.Serial, entry.RetryCount, entry.NextAttemptAt)
+}
+
+func (a *App) deleteRetryEntry(ctx context.Context, entry RetryEntry) {
+	if err := a.retries.DeleteRetry(ctx, entry.ID); err != nil {
+		a.logError("Failed to delete retry entry:", err.Error())
+		return
+	}
+	log.Printf("Deleted retry entry from PocketBase: ID=%s, Serial=%s", entry.ID, entry.Serial)
+}
+
+func (a *App) rescheduleRetry(ctx context.Context, entry RetryEntry, err error) {
+	entry.RetryCount++
+	entry.LastError = err.Error()
+	entry.Attempts = append(entry.Attempts, RetryAttempt{At: time.Now().Format(time.RFC3339), Error: err.Error()})
+	entry.NextAttemptAt = a.backoff.NextAttemptAt(entry.RetryCount)
+	a.logError("Retry failed for serial:", fmt.Sprintf("Serial: %s, Event: %s, Attempt: %d, Error: %v", entry.Serial, entry.Event, entry.RetryCount, err))
+	a.updateRetryEntry(ctx, entry)
+}
+
+// errRetryRejected marks a replayed event whose action failed permanently.
+var errRetryRejected = errors.New("event action failed")
+
+// failRetry moves an entry that failed permanently straight to the dead letters, the remaining attempts
+// would be rejected the same way.
+func (a *App) failRetry(ctx context.Context, entry RetryEntry, err error) {
+	entry.RetryCount++
+	entry.LastError = err.Error()
+	entry.Attempts = append(entry.Attempts, RetryAttempt{At: time.Now().Format(time.RFC3339), Error: err.Error()})
+	a.logError("Retry failed permanently for serial:", fmt.Sprintf("Serial: %s, Event: %s, Error: %v", entry.Serial, entry.Event, err))
+	a.settleIdempotencyByKey(ctx, ledgerKey(entry.IdempotencyKey, entry.Serial, entry.Event), WebhookOutcome{Status: IdempotencyFailed, Outcome: entry.LastError})
+	a.moveToDeadLetter(ctx, entry)
+}
+
+func (a *App) processRetry(ctx context.Context) {
+	maxRetries := 5
+
+	for {
+		started := time.Now()
+		if page, err := a.retries.ListRetries(ctx, ListOptions{Page: 1, PerPage: 1}); err == nil {
+			retryQueueSize.Set(float64(page.TotalItems))
+		}
+
+		entries, err := listAll(ctx, a.retries.ListRetries, ListOptions{
+			Filter: `next_attempt_at = "" || next_attempt_at <= @now`,
+			Sort:   "next_attempt_at",
+		})
+		if err != nil {
+			a.logError("Failed to fetch retry entries:", err.Error())
+			if !sleepCtx(ctx, 30*time.Second) {
+				return
+			}
+			continue
+		}
+
+		for _, entry := range entries {
+			if ctx.Err() != nil {
+				return
+			}
+
+			if entry.RetryCount >= maxRetries {
+				a.logError("Max retries reached for serial:", entry.Serial)
+				a.settleIdempotencyByKey(ctx, ledgerKey(entry.IdempotencyKey, entry.Serial, entry.Event), WebhookOutcome{Status: IdempotencyFailed, Outcome: entry.LastError})
+				a.moveToDeadLetter(ctx, entry)
+				continue
+			}
+
+			if err := a.retryHandler(entry.Event)(ctx, entry); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if isPermanentMCRMError(err) || errors.Is(err, errRetryRejected) {
+					a.failRetry(ctx, entry, err)
+					continue
+				}
+				a.rescheduleRetry(ctx, entry, err)
+				continue
+			}
+
+			a.deleteRetryEntry(ctx, entry)
+		}
+		observeLoop("retry", started)
+
+		if !sleepCtx(ctx, 30*time.Second) {
+			return
+		}
+	}
+}
+
+// retryWebhook replays the event action of a webhook that failed with a transient error.
+func (a *App) retryWebhook(ctx context.Context, entry RetryEntry) error {
+	outcome, _, err := a.dispatchEvent(ctx, WebhookEvent{Serial: entry.Serial, Event: entry.Event, Extra: entry.Extra})
+	if err != nil {
+		return err
+	}
+	if outcome.Status == IdempotencyFailed {
+		return fmt.Errorf("%w: %s", errRetryRejected, outcome.Outcome)
+	}
+	if outcome.Status != IdempotencySucceeded {
+		return fmt.Errorf("%s", outcome.Outcome)
+	}
+
+	logEntry := LogEntry{
+		ErrorMessage: "Retry processed successfully",
+		Timestamp:    time.Now().Format(time.RFC3339),
+		Response:     fmt.Sprintf("Serial: %s, Event: %s, %s", entry.Serial, entry.Event, outcome.Outcome),
+	}
+	if err := a.logs.CreateLog(ctx, logEntry); err != nil {
+		a.logError("Log save error:", err.Error())
+	} else {
+		log.Printf("Logged retry success: Serial=%s, Event=%s", entry.Serial, entry.Event)
+	}
+
+	a.settleIdempotencyByKey(ctx, ledgerKey(entry.IdempotencyKey, entry.Serial, entry.Event), outcome)
+	return nil
+}
+
+// retrySubscriber resolves the subscriber of a bonus or check_subscription entry, older entries only carry the phone as Serial.
+func (a *App) retrySubscriber(ctx context.Context, entry RetryEntry) (*SubscriberEntry, error) {
+	if entry.SubscriberUID > 0 {
+		return a.subscribers.GetSubscriberByUID(ctx, entry.SubscriberUID)
+	}
+	return a.subscribers.GetSubscriberByPhone(ctx, entry.Serial)
+}
+
+// retryCampaign resolves the subscriber and campaign of a bonus or check_subscription entry,
+// returning a nil subscriber when the bonus no longer needs to be granted.
+func (a *App) retryCampaign(ctx context.Context, entry RetryEntry) (*SubscriberEntry, CampaignConfig, error) {
+	sub, err := a.retrySubscriber(ctx, entry)
+	if err != nil {
+		return nil, CampaignConfig{}, fmt.Errorf("subscriber lookup error: %v", err)
+	}
+	campaign, ok := a.campaign(entry.CampaignID)
+	if !ok {
+		return nil, CampaignConfig{}, fmt.Errorf("unknown campaign: %q", entry.CampaignID)
+	}
+	if campaign.Retired || sub.bonusState(campaign.ID) != CampaignPending {
+		log.Printf("Campaign bonus no longer pending, dropping retry: UID=%d, Campaign=%s", sub.UID, campaign.ID)
+		return nil, campaign, nil
+	}
+	return sub, campaign, nil
+}
+
+func (a *App) retryBonus(ctx context.Context, entry RetryEntry) error {
+	sub, campaign, err := a.retryCampaign(ctx, entry)
+	if err != nil || sub == nil {
+		return err
+	}
+	return a.resendBonus(ctx, sub, campaign)
+}
+
+func (a *App) retryCheckSubscription(ctx context.Context, entry RetryEntry) error {
+	sub, campaign, err := a.retryCampaign(ctx, entry)
+	if err != nil || sub == nil {
+		return err
+	}
+
+	ok, err := a.hasRequiredStatus(ctx, sub.UID, campaign)
+	if err != nil || !ok {
+		return err
+	}
+	return a.resendBonus(ctx, sub, campaign)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeRetryStore struct {
+	entries []RetryEntry
+	filters []string
+	updated []RetryEntry
+}
+
+func (s *fakeRetryStore) CreateRetry(ctx context.Context, entry *RetryEntry) error {
+	for _, existing := range s.entries {
+		if existing.Serial == entry.Serial && existing.Event == entry.Event && existing.CampaignID == entry.CampaignID && existing.IdempotencyKey == entry.IdempotencyKey {
+			return &PocketBaseError{Method: http.MethodPost, StatusCode: http.StatusBadRequest,
+				Body: `{"data":{"serial":{"code":"validation_not_unique","message":"Value must be unique."}},"message":"Failed to create record.","status":400}`}
+		}
+	}
+	entry.ID = "new"
+	s.entries = append(s.entries, *entry)
+	return nil
+}
+
+func (s *fakeRetryStore) UpdateRetry(ctx context.Context, entry *RetryEntry) error {
+	s.updated = append(s.updated, *entry)
+	return nil
+}
+
+func (s *fakeRetryStore) DeleteRetry(ctx context.Context, id string) error {
+	return errors.New("not implemented")
+}
+
+func (s *fakeRetryStore) ListRetries(ctx context.Context, opts ListOptions) (*RecordPage[RetryEntry], error) {
+	s.filters = append(s.filters, opts.Filter)
+	return &RecordPage[RetryEntry]{Items: s.entries, TotalItems: len(s.entries), TotalPages: 1}, nil
+}
+
+func TestSaveRetryReschedulesExistingEntry(t *testing.T) {
+	sub := SubscriberEntry{UID: 42, Phone: "79990000000"}
+	later := time.Now().Add(time.Hour).UTC().Format(pbDateTime)
+	sooner := time.Now().Add(-time.Minute).UTC().Format(pbDateTime)
+
+	tests := []struct {
+		name     string
+		existing string
+		want     func(next string) bool
+	}{
+		{name: "later attempt is moved up", existing: later, want: func(next string) bool { return next < later }},
+		{name: "sooner attempt is kept", existing: sooner, want: func(next string) bool { return next == sooner }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeRetryStore{entries: []RetryEntry{{
+				ID: "old", Serial: sub.Phone, Event: RetryEventBonus, SubscriberUID: sub.UID, CampaignID: "spring",
+				RetryCount: 3, LastError: "first failure", NextAttemptAt: tt.existing,
+			}}}
+			a := &App{retries: store, logs: fakeLogStore{}, backoff: BackoffPolicy{Base: time.Second, Factor: 2}}
+
+			if err := a.addSubscriberRetry(sub, "spring", RetryEventBonus, "second failure"); err != nil {
+				t.Fatalf("addSubscriberRetry() = %v", err)
+			}
+			if len(store.entries) != 1 || len(store.updated) != 1 {
+				t.Fatalf("entries = %d, updates = %d, want the existing entry updated", len(store.entries), len(store.updated))
+			}
+			got := store.updated[0]
+			if got.ID != "old" || got.RetryCount != 3 || got.LastError != "second failure" || !tt.want(got.NextAttemptAt) {
+				t.Errorf("updated entry = %+v", got)
+			}
+			if filter := store.filters[0]; !strings.Contains(filter, `campaign_id = "spring"`) || !strings.Contains(filter, `idempotency_key = ""`) {
+				t.Errorf("lookup filter = %s", filter)
+			}
+		})
+	}
+}
+
+func TestSaveRetryCreatesNewEntry(t *testing.T) {
+	store := &fakeRetryStore{entries: []RetryEntry{{ID: "old", Serial: "123", Event: "purchase", IdempotencyKey: "123:purchase:key:a"}}}
+	a := &App{retries: store, logs: fakeLogStore{}}
+
+	if err := a.addToRetry(WebhookEvent{Serial: "123", Event: "purchase"}, "123:purchase:key:b", "timeout"); err != nil {
+		t.Fatalf("addToRetry() = %v", err)
+	}
+	if len(store.entries) != 2 || len(store.updated) != 0 {
+		t.Fatalf("entries = %d, updates = %d, want a second delivery stored separately", len(store.entries), len(store.updated))
+	}
+}
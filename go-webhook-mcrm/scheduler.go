@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Scheduler runs a job on a fixed interval and whenever it is nudged. Runs happen on a single
+// goroutine, so the job never overlaps itself; nudges arriving within the debounce window
+// (or while a run is in progress) collapse into one extra run.
+type Scheduler struct {
+	name     string
+	interval time.Duration
+	debounce time.Duration
+	trigger  chan struct{}
+	run      func(ctx context.Context)
+}
+
+func NewScheduler(name string, interval, debounce time.Duration, run func(ctx context.Context)) *Scheduler {
+	return &Scheduler{
+		name:     name,
+		interval: interval,
+		debounce: debounce,
+		trigger:  make(chan struct{}, 1),
+		run:      run,
+	}
+}
+
+// Nudge requests a run without blocking the caller.
+func (s *Scheduler) Nudge() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.trigger:
+			if !s.wait(ctx) {
+				return
+			}
+		}
+
+		started := time.Now()
+		s.run(ctx)
+		log.Printf("Scheduler %s run finished in %s", s.name, time.Since(started).Round(time.Millisecond))
+
+		timer.Reset(s.interval)
+	}
+}
+
+// wait holds a nudged run for the debounce window, absorbing further nudges.
+func (s *Scheduler) wait(ctx context.Context) bool {
+	debounce := time.NewTimer(s.debounce)
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-s.trigger:
+		case <-debounce.C:
+			return true
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	TimestampHeader = "X-Webhook-Timestamp"
+)
+
+var (
+	ErrSignatureMissing   = errors.New("missing webhook signature or timestamp")
+	ErrSignatureTimestamp = errors.New("webhook timestamp outside tolerance")
+	ErrSignatureMismatch  = errors.New("webhook signature mismatch")
+)
+
+// signPayload returns the hex HMAC-SHA256 of "<timestamp>.<body>".
+func signPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks the signature headers when signing secrets are configured. The
+// signature header may carry several comma separated values ("sha256=<hex>" or plain hex),
+// and every configured secret is tried so senders and receivers can rotate independently.
+func (a *App) verifySignature(header http.Header, body []byte, now time.Time) error {
+	secrets := a.config.Webhook.SigningSecrets
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	signatures := header.Get(SignatureHeader)
+	timestamp := header.Get(TimestampHeader)
+	if signatures == "" || timestamp == "" {
+		return ErrSignatureMissing
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook timestamp %q: %v", timestamp, err)
+	}
+	if skew := math.Abs(now.Sub(time.Unix(unix, 0)).Seconds()); skew > a.config.Webhook.SignatureTolerance.Seconds() {
+		return ErrSignatureTimestamp
+	}
+
+	for _, secret := range secrets {
+		expected := []byte(signPayload(secret, timestamp, body))
+		for _, signature := range strings.Split(signatures, ",") {
+			signature = strings.TrimPrefix(strings.TrimSpace(signature), "sha256=")
+			if hmac.Equal(expected, []byte(strings.ToLower(signature))) {
+				return nil
+			}
+		}
+	}
+	return ErrSignatureMismatch
+}
+
+// credentialsMatch compares BasicAuth credentials in constant time.
+func credentialsMatch(username, password, validUsername, validPassword string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(validUsername))
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(validPassword))
+	return userOK&passOK == 1
+}
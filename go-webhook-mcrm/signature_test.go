@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"serial":"123","event":"signup"}`)
+	stamp := func(at time.Time) string { return strconv.FormatInt(at.Unix(), 10) }
+
+	tests := []struct {
+		name      string
+		secrets   []string
+		signature string
+		timestamp string
+		body      []byte
+		want      error
+		wantAny   bool
+	}{
+		{
+			name:      "verification disabled without secrets",
+			signature: "garbage",
+			timestamp: stamp(now),
+		},
+		{
+			name:      "valid signature",
+			secrets:   []string{"current"},
+			signature: signPayload("current", stamp(now), body),
+			timestamp: stamp(now),
+		},
+		{
+			name:      "sha256 prefix and upper case hex",
+			secrets:   []string{"current"},
+			signature: "sha256=" + strings.ToUpper(signPayload("current", stamp(now), body)),
+			timestamp: stamp(now),
+		},
+		{
+			name:      "missing signature",
+			secrets:   []string{"current"},
+			timestamp: stamp(now),
+			want:      ErrSignatureMissing,
+		},
+		{
+			name:      "missing timestamp",
+			secrets:   []string{"current"},
+			signature: signPayload("current", stamp(now), body),
+			want:      ErrSignatureMissing,
+		},
+		{
+			name:      "malformed timestamp",
+			secrets:   []string{"current"},
+			signature: signPayload("current", "yesterday", body),
+			timestamp: "yesterday",
+			wantAny:   true,
+		},
+		{
+			name:      "old timestamp at the tolerance",
+			secrets:   []string{"current"},
+			signature: signPayload("current", stamp(now.Add(-5*time.Minute)), body),
+			timestamp: stamp(now.Add(-5 * time.Minute)),
+		},
+		{
+			name:      "future timestamp at the tolerance",
+			secrets:   []string{"current"},
+			signature: signPayload("current", stamp(now.Add(5*time.Minute)), body),
+			timestamp: stamp(now.Add(5 * time.Minute)),
+		},
+		{
+			name:      "old timestamp past the tolerance",
+			secrets:   []string{"current"},
+			signature: signPayload("current", stamp(now.Add(-5*time.Minute-time.Second)), body),
+			timestamp: stamp(now.Add(-5*time.Minute - time.Second)),
+			want:      ErrSignatureTimestamp,
+		},
+		{
+			name:      "future timestamp past the tolerance",
+			secrets:   []string{"current"},
+			signature: signPayload("current", stamp(now.Add(5*time.Minute+time.Second)), body),
+			timestamp: stamp(now.Add(5*time.Minute + time.Second)),
+			want:      ErrSignatureTimestamp,
+		},
+		{
+			name:      "signature of another timestamp",
+			secrets:   []string{"current"},
+			signature: signPayload("current", stamp(now.Add(-time.Minute)), body),
+			timestamp: stamp(now),
+			want:      ErrSignatureMismatch,
+		},
+		{
+			name:      "tampered body",
+			secrets:   []string{"current"},
+			signature: signPayload("current", stamp(now), body),
+			timestamp: stamp(now),
+			body:      []byte(`{"serial":"456","event":"signup"}`),
+			want:      ErrSignatureMismatch,
+		},
+		{
+			name:      "receiver rotated, sender still signs with the previous secret",
+			secrets:   []string{"current", "previous"},
+			signature: signPayload("previous", stamp(now), body),
+			timestamp: stamp(now),
+		},
+		{
+			name:      "sender rotated first, one of its signatures matches",
+			secrets:   []string{"previous"},
+			signature: "sha256=" + signPayload("next", stamp(now), body) + ", sha256=" + signPayload("previous", stamp(now), body),
+			timestamp: stamp(now),
+		},
+		{
+			name:      "retired secret",
+			secrets:   []string{"current"},
+			signature: signPayload("retired", stamp(now), body),
+			timestamp: stamp(now),
+			want:      ErrSignatureMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Webhook.SigningSecrets = tt.secrets
+			cfg.Webhook.SignatureTolerance = 5 * time.Minute
+			a := &App{config: cfg}
+
+			header := http.Header{}
+			if tt.signature != "" {
+				header.Set(SignatureHeader, tt.signature)
+			}
+			if tt.timestamp != "" {
+				header.Set(TimestampHeader, tt.timestamp)
+			}
+			received := body
+			if tt.body != nil {
+				received = tt.body
+			}
+
+			err := a.verifySignature(header, received, now)
+			switch {
+			case tt.wantAny:
+				if err == nil {
+					t.Fatal("verifySignature() = nil, want an error")
+				}
+			case !errors.Is(err, tt.want):
+				t.Fatalf("verifySignature() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
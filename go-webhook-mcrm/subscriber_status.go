@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Listmonk subscriber and subscription statuses the service acts on.
+const (
+	SubscriberBlocklisted    = "blocklisted"
+	SubscriptionConfirmed    = "confirmed"
+	SubscriptionUnsubscribed = "unsubscribed"
+)
+
+func (s *SubscriberEntry) blocklisted() bool {
+	return s.Status == SubscriberBlocklisted
+}
+
+// listStatus is the subscription status on listID, empty when the subscriber is not on the list.
+func (s *SubscriberEntry) listStatus(listID int) string {
+	return s.Lists[listID]
+}
+
+// updateListmonkStatus records the Listmonk status and subscriptions and keeps the first known
+// confirmation date of every list. It reports whether anything changed.
+func (s *SubscriberEntry) updateListmonkStatus(status string, lists, confirmed map[int]string) bool {
+	changed := s.Status != status || len(s.Lists) != len(lists)
+	for id, subscription := range lists {
+		if s.Lists[id] != subscription {
+			changed = true
+		}
+	}
+	s.Status = status
+	s.Lists = lists
+
+	for id, at := range confirmed {
+		if at == "" || s.Confirmed[id] != "" {
+			continue
+		}
+		if s.Confirmed == nil {
+			s.Confirmed = make(map[int]string)
+		}
+		s.Confirmed[id] = at
+		changed = true
+	}
+	return changed
+}
+
+// confirmedAt is when Listmonk confirmed the subscription, empty unless it is confirmed.
+// subscription_updated_at is the last status change, a subscription created confirmed may lack it.
+func (l ListmonkSubscription) confirmedAt() string {
+	if l.SubscriptionStatus != SubscriptionConfirmed {
+		return ""
+	}
+	at := l.SubscriptionUpdatedAt
+	if at == "" {
+		at = l.SubscriptionCreatedAt
+	}
+	if t, err := time.Parse(time.RFC3339Nano, at); err == nil {
+		return t.UTC().Format(time.RFC3339)
+	}
+	return at
+}
+
+// subscriptionsByList returns the subscription status and the confirmation date per list ID.
+func subscriptionsByList(subscriptions []ListmonkSubscription) (lists, confirmed map[int]string) {
+	lists = make(map[int]string, len(subscriptions))
+	confirmed = make(map[int]string)
+	for _, list := range subscriptions {
+		lists[list.ID] = list.SubscriptionStatus
+		if at := list.confirmedAt(); at != "" {
+			confirmed[list.ID] = at
+		}
+	}
+	return lists, confirmed
+}
+
+// refreshSubscriberStatus loads the subscriber's status, subscriptions and bounce count from
+// Listmonk. The caller saves the entry.
+func (a *App) refreshSubscriberStatus(ctx context.Context, sub *SubscriberEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	resp, err := a.listmonk.GetSubscriber(ctx, sub.UID)
+	if err != nil {
+		return err
+	}
+	lists, confirmed := subscriptionsByList(resp.Data.Lists)
+	sub.updateListmonkStatus(resp.Data.Status, lists, confirmed)
+
+	bounces, err := a.listmonk.SubscriberBounces(ctx, sub.UID)
+	if err != nil {
+		a.logError("Listmonk bounces API error:", fmt.Sprintf("UID: %d, %v", sub.UID, err), sub.UID)
+	} else {
+		sub.Bounces = bounces
+	}
+	sub.LastCheckedAt = time.Now().Format(time.RFC3339)
+	return nil
+}
+
+// CampaignFunnel counts the subscribers enrolled in a campaign by subscription status on the
+// campaign list and by bonus state. Confirmed counts those who ever confirmed the campaign list.
+type CampaignFunnel struct {
+	CampaignID    string         `json:"campaign_id"`
+	ListID        int            `json:"list_id"`
+	Enrolled      int            `json:"enrolled"`
+	Confirmed     int            `json:"confirmed"`
+	Subscriptions map[string]int `json:"subscriptions"`
+	Bonuses       map[string]int `json:"bonuses"`
+}
+
+type FunnelReport struct {
+	GeneratedAt string           `json:"generated_at"`
+	Subscribers int              `json:"subscribers"`
+	Statuses    map[string]int   `json:"statuses"`
+	Bounced     int              `json:"bounced"`
+	Confirmed   int              `json:"confirmed"`
+	Campaigns   []CampaignFunnel `json:"campaigns"`
+}
+
+// funnel serves GET /admin/funnel, the opt-in funnel built from the subscriber statuses in PocketBase.
+func (a *App) funnel(c echo.Context) error {
+	subscribers, err := listAll(c.Request().Context(), a.subscribers.ListSubscribers, ListOptions{PerPage: 200})
+	if err != nil {
+		a.logError("PocketBase fetch subscribers error:", err.Error())
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, buildFunnel(subscribers, a.config.Campaigns, time.Now()))
+}
+
+func buildFunnel(subscribers []SubscriberEntry, campaigns []CampaignConfig, now time.Time) FunnelReport {
+	report := FunnelReport{
+		GeneratedAt: now.Format(time.RFC3339),
+		Subscribers: len(subscribers),
+		Statuses:    make(map[string]int),
+		Campaigns:   make([]CampaignFunnel, 0, len(campaigns)),
+	}
+
+	for _, sub := range subscribers {
+		status := sub.Status
+		if status == "" {
+			status = "unknown"
+		}
+		report.Statuses[status]++
+		if sub.Bounces > 0 {
+			report.Bounced++
+		}
+		if len(sub.Confirmed) > 0 {
+			report.Confirmed++
+		}
+	}
+
+	for _, campaign := range campaigns {
+		funnel := CampaignFunnel{
+			CampaignID:    campaign.ID,
+			ListID:        campaign.ListID,
+			Subscriptions: make(map[string]int),
+			Bonuses:       make(map[string]int),
+		}
+		for i := range subscribers {
+			sub := &subscribers[i]
+			state := sub.bonusState(campaign.ID)
+			if state == "" {
+				continue
+			}
+			funnel.Enrolled++
+			funnel.Bonuses[state]++
+			if sub.Confirmed[campaign.ListID] != "" {
+				funnel.Confirmed++
+			}
+
+			subscription := sub.listStatus(campaign.ListID)
+			switch {
+			case sub.blocklisted():
+				subscription = SubscriberBlocklisted
+			case subscription == "" && sub.Lists == nil:
+				subscription = "unknown"
+			case subscription == "":
+				subscription = "not in list"
+			}
+			funnel.Subscriptions[subscription]++
+		}
+		report.Campaigns = append(report.Campaigns, funnel)
+	}
+	return report
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionsByList(t *testing.T) {
+	lists, confirmed := subscriptionsByList([]ListmonkSubscription{
+		{ID: 3, SubscriptionStatus: SubscriptionConfirmed, SubscriptionCreatedAt: "2026-01-01T09:00:00.5+03:00", SubscriptionUpdatedAt: "2026-01-02T10:00:00.123456+03:00"},
+		{ID: 4, SubscriptionStatus: SubscriptionConfirmed, SubscriptionCreatedAt: "2026-01-05T12:00:00Z"},
+		{ID: 5, SubscriptionStatus: "unconfirmed", SubscriptionCreatedAt: "2026-01-03T12:00:00Z", SubscriptionUpdatedAt: "2026-01-03T12:00:00Z"},
+		{ID: 6, SubscriptionStatus: SubscriptionUnsubscribed, SubscriptionUpdatedAt: "2026-01-04T12:00:00Z"},
+	})
+
+	wantLists := map[int]string{3: SubscriptionConfirmed, 4: SubscriptionConfirmed, 5: "unconfirmed", 6: SubscriptionUnsubscribed}
+	if !reflect.DeepEqual(lists, wantLists) {
+		t.Errorf("lists = %v, want %v", lists, wantLists)
+	}
+	wantConfirmed := map[int]string{3: "2026-01-02T07:00:00Z", 4: "2026-01-05T12:00:00Z"}
+	if !reflect.DeepEqual(confirmed, wantConfirmed) {
+		t.Errorf("confirmed = %v, want %v", confirmed, wantConfirmed)
+	}
+}
+
+func TestUpdateListmonkStatusKeepsFirstConfirmation(t *testing.T) {
+	sub := SubscriberEntry{}
+	if !sub.updateListmonkStatus("enabled", map[int]string{3: SubscriptionConfirmed}, map[int]string{3: "2026-01-02T07:00:00Z"}) {
+		t.Fatal("first confirmation reported no change")
+	}
+	if sub.updateListmonkStatus("enabled", map[int]string{3: SubscriptionConfirmed}, map[int]string{3: "2026-02-01T07:00:00Z"}) {
+		t.Error("later subscription update reported a change")
+	}
+	sub.updateListmonkStatus("enabled", map[int]string{3: SubscriptionUnsubscribed, 4: SubscriptionConfirmed}, map[int]string{4: "2026-03-01T07:00:00Z"})
+
+	want := map[int]string{3: "2026-01-02T07:00:00Z", 4: "2026-03-01T07:00:00Z"}
+	if !reflect.DeepEqual(sub.Confirmed, want) {
+		t.Errorf("Confirmed = %v, want %v", sub.Confirmed, want)
+	}
+}
+
+func TestBuildFunnelConfirmedPerCampaignList(t *testing.T) {
+	campaigns := []CampaignConfig{{ID: "spring", ListID: 3}, {ID: "summer", ListID: 4}}
+	subscribers := []SubscriberEntry{
+		{UID: 1, Status: "enabled", Bonuses: map[string]string{"spring": CampaignGranted, "summer": CampaignPending},
+			Lists: map[int]string{3: SubscriptionConfirmed, 4: "unconfirmed"}, Confirmed: map[int]string{3: "2026-01-02T07:00:00Z"}},
+		{UID: 2, Status: "enabled", Bonuses: map[string]string{"summer": CampaignPending},
+			Lists: map[int]string{3: SubscriptionConfirmed, 4: "unconfirmed"}, Confirmed: map[int]string{3: "2026-01-03T07:00:00Z"}},
+		{UID: 3, Status: "enabled", Bonuses: map[string]string{"spring": CampaignPending}},
+	}
+
+	report := buildFunnel(subscribers, campaigns, time.Now())
+	if report.Confirmed != 2 {
+		t.Errorf("Confirmed = %d, want 2", report.Confirmed)
+	}
+	for _, funnel := range report.Campaigns {
+		want := map[string]int{"spring": 1, "summer": 0}[funnel.CampaignID]
+		if funnel.Confirmed != want {
+			t.Errorf("campaign %s Confirmed = %d, want %d", funnel.CampaignID, funnel.Confirmed, want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// listmonkQuote renders a string literal for a Listmonk SQL subscriber query.
+func listmonkQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+func (a *App) findListmonkSubscriberByEmail(ctx context.Context, email string) (*ListmonkGetResponse, error) {
+	if email == "" {
+		return nil, nil
+	}
+	resp, err := a.listmonk.ListSubscribers(ctx, ListmonkSubscriberQuery{
+		Query:   "LOWER(subscribers.email) = LOWER(" + listmonkQuote(email) + ")",
+		Page:    1,
+		PerPage: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data.Results) == 0 {
+		return nil, nil
+	}
+	return a.listmonk.GetSubscriber(ctx, resp.Data.Results[0].ID)
+}
+
+// upsertListmonkSubscriber creates the subscriber, or when the email is already known to Listmonk
+// adds it to listIDs and merges the new attribs into the existing ones.
+func (a *App) upsertListmonkSubscriber(ctx context.Context, req ListmonkSubscriberRequest, listIDs []int) (SubscriberEntry, error) {
+	existing, err := a.findListmonkSubscriberByEmail(ctx, req.Email)
+	if err != nil {
+		return SubscriberEntry{}, err
+	}
+
+	if existing == nil {
+		created, err := a.listmonk.CreateSubscriber(ctx, req)
+		if err == nil {
+			lists, confirmed := subscriptionsByList(created.Data.Lists)
+			return SubscriberEntry{
+				UID:       created.Data.ID,
+				Email:     created.Data.Email,
+				Phone:     attribString(created.Data.Attribs, "phone"),
+				Status:    created.Data.Status,
+				Lists:     lists,
+				Confirmed: confirmed,
+			}, nil
+		}
+		if !IsListmonkStatus(err, http.StatusConflict) {
+			return SubscriberEntry{}, err
+		}
+		// Created concurrently between the lookup and the POST.
+		existing, _ = a.findListmonkSubscriberByEmail(ctx, req.Email)
+		if existing == nil {
+			return SubscriberEntry{}, err
+		}
+	}
+
+	return a.mergeListmonkSubscriber(ctx, existing, req, listIDs)
+}
+
+// listmonkRequestFrom builds an update request that keeps every field of the existing subscriber.
+func listmonkRequestFrom(existing *ListmonkGetResponse) ListmonkSubscriberRequest {
+	attribs := make(map[string]interface{}, len(existing.Data.Attribs))
+	for key, value := range existing.Data.Attribs {
+		attribs[key] = value
+	}
+	lists := make([]int, 0, len(existing.Data.Lists))
+	for _, list := range existing.Data.Lists {
+		lists = append(lists, list.ID)
+	}
+	return ListmonkSubscriberRequest{
+		Email:   existing.Data.Email,
+		Name:    existing.Data.Name,
+		Status:  existing.Data.Status,
+		Lists:   lists,
+		Attribs: attribs,
+	}
+}
+
+// mergeListmonkSubscriber adds the existing subscriber to listIDs and merges the non-empty attribs
+// of req into its own, keeping its status.
+func (a *App) mergeListmonkSubscriber(ctx context.Context, existing *ListmonkGetResponse, req ListmonkSubscriberRequest, listIDs []int) (SubscriberEntry, error) {
+	attribs := make(map[string]interface{}, len(existing.Data.Attribs)+len(req.Attribs))
+	for key, value := range existing.Data.Attribs {
+		attribs[key] = value
+	}
+	for key, value := range req.Attribs {
+		if str, ok := value.(string); ok && str == "" {
+			continue
+		}
+		attribs[key] = value
+	}
+
+	lists := append([]int(nil), listIDs...)
+	for _, list := range existing.Data.Lists {
+		if !containsInt(listIDs, list.ID) {
+			lists = append(lists, list.ID)
+		}
+	}
+
+	name := existing.Data.Name
+	if strings.TrimSpace(name) == "" {
+		name = req.Name
+	}
+
+	updated, err := a.listmonk.UpdateSubscriber(ctx, existing.Data.ID, ListmonkSubscriberRequest{
+		Email:   existing.Data.Email,
+		Name:    name,
+		Status:  existing.Data.Status,
+		Lists:   lists,
+		Attribs: attribs,
+	})
+	if err != nil {
+		return SubscriberEntry{}, err
+	}
+	log.Printf("Merged existing Listmonk subscriber: UID=%d, Email=%s, ListIDs=%v", updated.Data.ID, updated.Data.Email, listIDs)
+
+	subscriptions, confirmed := subscriptionsByList(updated.Data.Lists)
+	return SubscriberEntry{
+		UID:       updated.Data.ID,
+		Email:     updated.Data.Email,
+		Phone:     attribString(updated.Data.Attribs, "phone"),
+		Status:    updated.Data.Status,
+		Lists:     subscriptions,
+		Confirmed: confirmed,
+	}, nil
+}
+
+// saveSubscriberEntry reuses the PocketBase record with the same UID instead of creating a duplicate
+// and enrolls the subscriber in the campaigns it has no bonus state for yet.
+func (a *App) saveSubscriberEntry(ctx context.Context, sub SubscriberEntry, campaigns []CampaignConfig) (*SubscriberEntry, error) {
+	existing, err := a.subscribers.GetSubscriberByUID(ctx, sub.UID)
+	if err != nil && !errors.Is(err, ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if existing == nil {
+		sub.Bonuses = make(map[string]string)
+		sub.enroll(campaigns)
+		if sub.Status != "" {
+			sub.updateListmonkStatus(sub.Status, sub.Lists, sub.Confirmed)
+		}
+		if err := a.subscribers.CreateSubscriber(ctx, &sub); err != nil {
+			return nil, err
+		}
+		log.Printf("Saved subscriber to PocketBase: UID=%d, Email=%s, Phone=%s", sub.UID, sub.Email, sub.Phone)
+		return &sub, nil
+	}
+
+	changed := existing.enroll(campaigns)
+	if sub.Status != "" && existing.updateListmonkStatus(sub.Status, sub.Lists, sub.Confirmed) {
+		changed = true
+	}
+	if changed || existing.Email != sub.Email || (sub.Phone != "" && existing.Phone != sub.Phone) {
+		existing.Email = sub.Email
+		if sub.Phone != "" {
+			existing.Phone = sub.Phone
+		}
+		if err := a.subscribers.UpdateSubscriber(ctx, existing); err != nil {
+			return nil, err
+		}
+		log.Printf("Updated subscriber in PocketBase: UID=%d, Email=%s, Phone=%s", existing.UID, existing.Email, existing.Phone)
+	}
+	return existing, nil
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
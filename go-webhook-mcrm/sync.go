@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// syncOverlap is subtracted from the watermark so clock skew between this service and the
+// Listmonk database does not lose updates. Re-syncing a subscriber is harmless.
+const syncOverlap = time.Minute
+
+// SyncState is the watermark of the last complete Listmonk sync of a list.
+type SyncState struct {
+	ID        string `json:"id"`
+	Key       string `json:"key"`
+	Watermark string `json:"watermark"`
+	Synced    int    `json:"synced"`
+	SyncedAt  string `json:"synced_at"`
+}
+
+type SyncStateStore interface {
+	GetSyncState(ctx context.Context, key string) (*SyncState, error)
+	SaveSyncState(ctx context.Context, state *SyncState) error
+}
+
+func syncStateKey(listID int) string {
+	return fmt.Sprintf("listmonk_list_%d", listID)
+}
+
+// syncQuery selects subscribers updated since the watermark. Joining or confirming a list only
+// touches subscriber_lists, so those rows are checked too.
+func syncQuery(listID int, since time.Time) string {
+	ts := since.UTC().Format(time.RFC3339)
+	return fmt.Sprintf("subscribers.updated_at >= '%s' OR subscribers.id IN (SELECT subscriber_id FROM subscriber_lists WHERE list_id = %d AND updated_at >= '%s')", ts, listID, ts)
+}
+
+// syncListmonkSubscribers copies the subscribers of listID changed since the last complete sync
+// into PocketBase. Without a stored watermark the whole list is synced.
+func (a *App) syncListmonkSubscribers(ctx context.Context, listID int) {
+	defer observeLoop("listmonk_sync", time.Now())
+
+	if listID <= 0 {
+		a.logError("Invalid listID:", fmt.Sprintf("listID=%d is not a valid identifier", listID))
+		return
+	}
+
+	started := time.Now()
+	state, err := a.syncState.GetSyncState(ctx, syncStateKey(listID))
+	if errors.Is(err, ErrRecordNotFound) {
+		state = &SyncState{Key: syncStateKey(listID)}
+	} else if err != nil {
+		a.logError("PocketBase sync state error:", err.Error())
+		return
+	}
+
+	query := ListmonkSubscriberQuery{ListID: listID, OrderBy: "id", Order: "asc", PerPage: 1000}
+	if watermark, err := time.Parse(time.RFC3339, state.Watermark); err == nil {
+		query.Query = syncQuery(listID, watermark.Add(-syncOverlap))
+		log.Printf("Syncing Listmonk list %d changes since %s", listID, state.Watermark)
+	} else {
+		log.Printf("Syncing all subscribers of Listmonk list %d", listID)
+	}
+
+	allSubscribers, err := listAll(ctx, a.subscribers.ListSubscribers, ListOptions{PerPage: 100})
+	if err != nil {
+		a.logError("Ошибка загрузки из PocketBase:", err.Error())
+		return
+	}
+	existingSubscribers := make(map[int]SubscriberEntry, len(allSubscribers))
+	for _, sub := range allSubscribers {
+		existingSubscribers[sub.UID] = sub
+	}
+
+	campaigns := a.campaignsForList(listID, started)
+	synced := 0
+	complete := true
+	for query.Page = 1; ; query.Page++ {
+		listmonkResp, err := a.listmonk.ListSubscribers(ctx, query)
+		if err != nil {
+			a.logError("Listmonk GET subscribers API error:", err.Error())
+			complete = false
+			break
+		}
+
+		for _, subscriber := range listmonkResp.Data.Results {
+			isInList := false
+			for _, list := range subscriber.Lists {
+				if list.ID == listID {
+					isInList = true
+					break
+				}
+			}
+			if !isInList {
+				continue
+			}
+
+			phone := attribString(subscriber.Attribs, "phone")
+			lists, confirmed := subscriptionsByList(subscriber.Lists)
+
+			if existingSub, exists := existingSubscribers[subscriber.ID]; exists {
+				changed := existingSub.enroll(campaigns)
+				if existingSub.updateListmonkStatus(subscriber.Status, lists, confirmed) {
+					changed = true
+				}
+				if changed || existingSub.Email != subscriber.Email || existingSub.Phone != phone {
+					existingSub.Email = subscriber.Email
+					existingSub.Phone = phone
+					if err := a.subscribers.UpdateSubscriber(ctx, &existingSub); err != nil {
+						a.logError("Ошибка обновления подписчика:", err.Error())
+						complete = false
+						continue
+					}
+					existingSubscribers[subscriber.ID] = existingSub
+					synced++
+					log.Printf("Updated subscriber in PocketBase: UID=%d, Email=%s, Phone=%s", subscriber.ID, subscriber.Email, phone)
+				}
+			} else {
+				newSubscriber := SubscriberEntry{
+					UID:     subscriber.ID,
+					Email:   subscriber.Email,
+					Phone:   phone,
+					Bonuses: make(map[string]string),
+				}
+				newSubscriber.enroll(campaigns)
+				newSubscriber.updateListmonkStatus(subscriber.Status, lists, confirmed)
+				if err := a.subscribers.CreateSubscriber(ctx, &newSubscriber); err != nil {
+					a.logError("Ошибка сохранения нового подписчика:", err.Error())
+					complete = false
+					continue
+				}
+				existingSubscribers[subscriber.ID] = newSubscriber
+				synced++
+				log.Printf("Saved new subscriber to PocketBase: UID=%d, Email=%s, Phone=%s", subscriber.ID, subscriber.Email, phone)
+			}
+		}
+
+		if len(listmonkResp.Data.Results) == 0 || query.Page*listmonkResp.Data.PerPage >= listmonkResp.Data.Total {
+			break
+		}
+		if !sleepCtx(ctx, 1*time.Second) {
+			return
+		}
+	}
+
+	// A failed run keeps the old watermark so the next run picks up what was missed.
+	if !complete {
+		return
+	}
+	state.Watermark = started.UTC().Format(time.RFC3339)
+	state.Synced = synced
+	state.SyncedAt = time.Now().Format(time.RFC3339)
+	if err := a.syncState.SaveSyncState(ctx, state); err != nil {
+		a.logError("PocketBase sync state save error:", err.Error())
+		return
+	}
+	log.Printf("Synced Listmonk list %d: %d subscribers changed, watermark %s", listID, synced, state.Watermark)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// WebhookEvent is the payload of POST /webhook, accepted as JSON, form or query string.
+// Fields other than serial, event and timestamp are kept in Extra.
+type WebhookEvent struct {
+	Serial    string                 `json:"serial"`
+	Event     string                 `json:"event"`
+	Timestamp string                 `json:"timestamp,omitempty"`
+	Extra     map[string]interface{} `json:"extra,omitempty"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		parts[i] = f.Field + ": " + f.Message
+	}
+	return "invalid webhook payload: " + strings.Join(parts, "; ")
+}
+
+var eventNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+// parseWebhookEvent picks the decoder from the Content-Type, falling back to the query string
+// for fields the body does not set.
+func parseWebhookEvent(c echo.Context, body []byte) (*WebhookEvent, error) {
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+
+	var fields map[string]interface{}
+	switch {
+	case mediaType == echo.MIMEApplicationJSON || strings.HasSuffix(mediaType, "+json"):
+		if len(strings.TrimSpace(string(body))) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.UseNumber()
+			if err := decoder.Decode(&fields); err != nil {
+				return nil, &ValidationError{Fields: []FieldError{{Field: "body", Message: fmt.Sprintf("invalid JSON: %v", err)}}}
+			}
+		}
+	case mediaType == echo.MIMEMultipartForm:
+		form, err := c.MultipartForm()
+		if err != nil {
+			return nil, &ValidationError{Fields: []FieldError{{Field: "body", Message: fmt.Sprintf("invalid multipart form: %v", err)}}}
+		}
+		fields = valuesToFields(form.Value)
+	case mediaType == echo.MIMEApplicationForm || mediaType == "":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, &ValidationError{Fields: []FieldError{{Field: "body", Message: fmt.Sprintf("invalid form body: %v", err)}}}
+		}
+		fields = valuesToFields(values)
+	default:
+		return nil, &ValidationError{Fields: []FieldError{{Field: "content-type", Message: fmt.Sprintf("unsupported content type %q", mediaType)}}}
+	}
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	for key, value := range valuesToFields(c.QueryParams()) {
+		if _, ok := fields[key]; !ok {
+			fields[key] = value
+		}
+	}
+
+	event := &WebhookEvent{Extra: make(map[string]interface{})}
+	var errs []FieldError
+	for key, value := range fields {
+		switch key {
+		case "serial", "event", "timestamp":
+			str, ok := scalarString(value)
+			if !ok {
+				errs = append(errs, FieldError{Field: key, Message: "must be a string or number"})
+				continue
+			}
+			switch key {
+			case "serial":
+				event.Serial = str
+			case "event":
+				event.Event = str
+			case "timestamp":
+				event.Timestamp = str
+			}
+		default:
+			event.Extra[key] = value
+		}
+	}
+
+	reported := make(map[string]bool, len(errs))
+	for _, e := range errs {
+		reported[e.Field] = true
+	}
+	for _, e := range event.validate() {
+		if !reported[e.Field] {
+			errs = append(errs, e)
+		}
+	}
+	if len(errs) > 0 {
+		return event, &ValidationError{Fields: errs}
+	}
+	return event, nil
+}
+
+func (e *WebhookEvent) validate() []FieldError {
+	var errs []FieldError
+	if strings.TrimSpace(e.Serial) == "" {
+		errs = append(errs, FieldError{Field: "serial", Message: "is required"})
+	}
+	if e.Event == "" {
+		errs = append(errs, FieldError{Field: "event", Message: "is required"})
+	} else if !eventNamePattern.MatchString(e.Event) {
+		errs = append(errs, FieldError{Field: "event", Message: "must be 1-64 characters of letters, digits, '_', '.', ':' or '-'"})
+	}
+	if e.Timestamp != "" {
+		if _, err := parseEventTime(e.Timestamp); err != nil {
+			errs = append(errs, FieldError{Field: "timestamp", Message: "must be RFC 3339 or unix seconds"})
+		}
+	}
+	return errs
+}
+
+func parseEventTime(value string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// valuesToFields keeps single form values as strings and repeated ones as lists.
+func valuesToFields(values map[string][]string) map[string]interface{} {
+	fields := make(map[string]interface{}, len(values))
+	for key, list := range values {
+		if len(list) == 1 {
+			fields[key] = list[0]
+			continue
+		}
+		items := make([]interface{}, len(list))
+		for i, v := range list {
+			items[i] = v
+		}
+		fields[key] = items
+	}
+	return fields
+}
+
+func scalarString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}